@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vinhut/like-service/models"
+	"github.com/vinhut/like-service/services"
+
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// adminRoles returns the roles of the comma separated config that may use
+// the admin routes, admin when it lists none.
+func adminRoles(config string) []string {
+	roles := []string{}
+	for _, role := range strings.Split(config, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		roles = []string{"admin"}
+	}
+	return roles
+}
+
+// setupAdminRoutes adds the admin routes for users with one of roles.
+func setupAdminRoutes(router *gin.Engine, likedb models.LikeDatabase, auditdb models.AuditDatabase, authservice services.AuthService, roles []string) {
+
+	admin := router.Group(SERVICE_NAME+"/admin", authenticate(authservice, authRoles(roles...)))
+	admin.GET("/user/:uid/likes", validUidParam, adminUserLikeHandler(likedb, auditdb))
+	admin.DELETE("/user/:uid/likes", validUidParam, adminDeleteUserLikesHandler(likedb, auditdb))
+	valid := validTarget(generic_target)
+	admin.DELETE("/target/:type", valid, adminDeleteTargetLikesHandler(likedb, auditdb))
+	admin.POST("/target/:type/count", valid, adminReconcileCountHandler(likedb, auditdb))
+	// the expvars, such as the command line and the auth cache stats, are
+	// only for admins
+	admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+}
+
+func validUidParam(c *gin.Context) {
+	if err := models.ValidUid(c.Param("uid")); err != nil {
+		abortInvalid(c, "uid", err)
+		return
+	}
+	c.Next()
+}
+
+// audit records the admin action about to be carried out, and aborts the
+// request if it cannot, so no admin action goes unrecorded.
+func audit(c *gin.Context, auditdb models.AuditDatabase, action string, uid string, target models.Target) bool {
+
+	admin := currentUser(c)
+	record := models.AuditRecord{
+		Actor:      admin.Uid,
+		Role:       admin.Role,
+		Action:     action,
+		Uid:        uid,
+		Targettype: target.Type,
+		Targetid:   target.Id,
+		Created:    time.Now(),
+	}
+	if err := auditdb.Record(c.Request.Context(), record); err != nil {
+		fmt.Println("audit record error ", err)
+		c.AbortWithStatusJSON(storageErrorStatus(err), gin.H{"reason": "audit record error"})
+		return false
+	}
+	return true
+}
+
+func adminUserLikeHandler(likedb models.LikeDatabase, auditdb models.AuditDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		uid := c.Param("uid")
+		target_type, _ := c.GetQuery("type")
+		cursor, _ := c.GetQuery("cursor")
+		limit, limit_ok := pageLimit(c)
+		if !limit_ok {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid limit"})
+			return
+		}
+		if !audit(c, auditdb, "list user likes", uid, models.Target{}) {
+			return
+		}
+
+		user_like, next, find_err := likedb.FindUserLike(c.Request.Context(), uid, target_type, cursor, limit)
+		if find_err == models.ErrInvalidCursor {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid cursor"})
+			return
+		}
+		if find_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid type"})
+			return
+		}
+		if find_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(find_err), gin.H{"reason": "find user like error"})
+			return
+		}
+		c.JSON(200, gin.H{"likes": user_like, "next": next})
+
+	}
+}
+
+func adminDeleteUserLikesHandler(likedb models.LikeDatabase, auditdb models.AuditDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		uid := c.Param("uid")
+		if !audit(c, auditdb, "delete user likes", uid, models.Target{}) {
+			return
+		}
+
+		deleted, delete_err := likedb.DeleteUserLikes(c.Request.Context(), uid)
+		if delete_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(delete_err), gin.H{"reason": "delete user likes error", "deleted": deleted})
+			return
+		}
+		c.JSON(200, gin.H{"deleted": deleted})
+
+	}
+}
+
+func adminDeleteTargetLikesHandler(likedb models.LikeDatabase, auditdb models.AuditDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := generic_target.target(c)
+		tagTarget(c, target)
+		if !audit(c, auditdb, "delete target likes", "", target) {
+			return
+		}
+
+		deleted, delete_err := likedb.DeleteTargetLikes(c.Request.Context(), target)
+		if delete_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if delete_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(delete_err), gin.H{"reason": "delete target likes error"})
+			return
+		}
+		c.JSON(200, gin.H{"deleted": deleted})
+
+	}
+}
+
+func adminReconcileCountHandler(likedb models.LikeDatabase, auditdb models.AuditDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := generic_target.target(c)
+		tagTarget(c, target)
+		if !audit(c, auditdb, "reconcile count", "", target) {
+			return
+		}
+
+		like_count, reconcile_err := likedb.ReconcileCount(c.Request.Context(), target)
+		if reconcile_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if reconcile_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(reconcile_err), gin.H{"reason": "reconcile count error"})
+			return
+		}
+		c.JSON(200, gin.H{"count": like_count})
+
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vinhut/like-service/services"
+
+	"errors"
+	"strings"
+)
+
+// the gin context key the authenticated user is stored under
+const USER_KEY = "user"
+
+// authPolicy says who may use a route. By default a route needs a user;
+// optional routes also serve anonymous clients, and a route with roles only
+// serves users with one of them.
+type authPolicy struct {
+	optional bool
+	roles    []string
+}
+
+var (
+	auth_required = authPolicy{}
+	auth_optional = authPolicy{optional: true}
+)
+
+func authRoles(roles ...string) authPolicy {
+	return authPolicy{roles: roles}
+}
+
+// authError maps a failed user check to its status, code and message: 503
+// when the auth service could not vouch for the token either way, 401
+// otherwise.
+func authError(err error) (int, string, string) {
+	if errors.Is(err, services.ErrUnavailable) || errors.Is(err, services.ErrMalformedResponse) {
+		return 503, "auth_unavailable", "auth service unavailable"
+	}
+	return 401, "unauthorized", "unauthorized"
+}
+
+// requestToken returns the token of the request, from an Authorization
+// Bearer header, as mobile clients send it, or else from the token cookie.
+// sent reports whether the client sent credentials at all, a malformed
+// header leaves the token empty.
+func requestToken(c *gin.Context) (token string, sent bool) {
+	if header := c.GetHeader("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return "", true
+		}
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), true
+	}
+	token, cookie_err := c.Cookie("token")
+	return token, cookie_err == nil
+}
+
+// authenticate checks the token of the request and stores its user in the
+// context for the handlers, enforcing policy. A client of an optional route
+// that sends no token goes on without a user, but one sending a token that
+// does not check out is turned away like anywhere else.
+func authenticate(authservice services.AuthService, policy authPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		token, sent := requestToken(c)
+		if !sent && policy.optional {
+			c.Next()
+			return
+		}
+		if token == "" {
+			abortError(c, 401, "unauthorized", "unauthorized")
+			return
+		}
+
+		user_data, check_err := checkUser(c.Request.Context(), authservice, token)
+		if check_err != nil {
+			status, code, message := authError(check_err)
+			abortError(c, status, code, message)
+			return
+		}
+		tagSpan(c, "uid", user_data.Uid)
+
+		if len(policy.roles) > 0 && !hasRole(user_data, policy.roles) {
+			abortError(c, 403, "forbidden", "forbidden")
+			return
+		}
+		c.Set(USER_KEY, user_data)
+		c.Next()
+	}
+}
+
+func hasRole(user_data *UserAuthData, roles []string) bool {
+	for _, role := range roles {
+		if user_data.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// currentUser returns the user authenticate stored, nil for an anonymous
+// client of an optional route.
+func currentUser(c *gin.Context) *UserAuthData {
+	user_data, ok := c.Get(USER_KEY)
+	if !ok {
+		return nil
+	}
+	return user_data.(*UserAuthData)
+}
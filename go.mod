@@ -1,8 +1,9 @@
 module github.com/vinhut/like-service
 
-go 1.13
+go 1.15
 
 require (
+	github.com/codahale/hdrhistogram v0.0.0-20161010025455-3a0bb77429bd // indirect
 	github.com/gin-gonic/gin v1.5.0
 	github.com/golang/mock v1.4.3
 	github.com/opentracing/opentracing-go v1.2.0
@@ -11,4 +12,6 @@ require (
 	github.com/uber/jaeger-lib v2.2.0+incompatible
 	go.mongodb.org/mongo-driver v1.3.1
 	go.uber.org/atomic v1.6.0 // indirect
+	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9
+	modernc.org/sqlite v1.10.8
 )
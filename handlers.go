@@ -0,0 +1,395 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vinhut/like-service/helpers"
+	"github.com/vinhut/like-service/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"errors"
+	"strconv"
+	"time"
+)
+
+// targetParams says where a route reads its target from. The type is fixed
+// on the legacy alias routes such as /post, and read from the :type path
+// parameter otherwise. The id is read from the IdParam query parameter, or
+// the path parameter of that name with PathId.
+type targetParams struct {
+	Type    string
+	IdParam string
+	PathId  bool
+}
+
+var (
+	generic_target = targetParams{IdParam: "id"}
+	path_target    = targetParams{IdParam: "id", PathId: true}
+)
+
+func aliasTarget(targettype string) targetParams {
+	return targetParams{Type: targettype, IdParam: targettype + "id"}
+}
+
+func (params targetParams) targetType(c *gin.Context) string {
+	if params.Type != "" {
+		return params.Type
+	}
+	return c.Param("type")
+}
+
+func (params targetParams) target(c *gin.Context) models.Target {
+	if params.PathId {
+		return models.Target{Type: params.targetType(c), Id: c.Param(params.IdParam)}
+	}
+	id, _ := c.GetQuery(params.IdParam)
+	return models.Target{Type: params.targetType(c), Id: id}
+}
+
+// validTarget turns away requests whose target id is missing or malformed
+// before they reach the handler.
+func validTarget(params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		target := params.target(c)
+		if err := models.ValidTargetId(target.Type, target.Id); err != nil {
+			abortInvalid(c, params.IdParam, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// validIds checks every id of a batch, aborting on the first bad one.
+func validIds(c *gin.Context, targettype string, field string, ids []string) bool {
+	for _, id := range ids {
+		if err := models.ValidTargetId(targettype, id); err != nil {
+			abortInvalid(c, field, err)
+			return false
+		}
+	}
+	return true
+}
+
+// storageErrorStatus maps a storage failure to its HTTP status: 504 when the
+// query timed out, 503 when the database could not be reached and 500 for
+// anything else.
+func storageErrorStatus(err error) int {
+	if errors.Is(err, helpers.ErrTimeout) {
+		return 504
+	}
+	if errors.Is(err, helpers.ErrUnavailable) {
+		return 503
+	}
+	return 500
+}
+
+func getCountHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+
+		if since, ok := c.GetQuery("since"); ok {
+			getCountSince(c, likedb, target, since)
+			return
+		}
+
+		like_count, reactions, find_err := likedb.FindCount(c.Request.Context(), target)
+		if find_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if find_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(find_err), gin.H{"reason": "find like count error"})
+			return
+		}
+		if wantsDetail(c) {
+			c.JSON(200, gin.H{"count": like_count, "reactions": reactions})
+		} else {
+			c.String(200, strconv.Itoa(like_count))
+		}
+
+	}
+}
+
+// getCountSince answers a count request with ?since=, an RFC 3339 time,
+// with the count of the likes made since then.
+func getCountSince(c *gin.Context, likedb models.LikeDatabase, target models.Target, since_str string) {
+
+	since, parse_err := time.Parse(time.RFC3339, since_str)
+	if parse_err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"reason": "invalid since"})
+		return
+	}
+	like_count, find_err := likedb.CountSince(c.Request.Context(), target, since)
+	if find_err == models.ErrInvalidTargetType {
+		c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+		return
+	}
+	if find_err != nil {
+		c.AbortWithStatusJSON(storageErrorStatus(find_err), gin.H{"reason": "find like count error"})
+		return
+	}
+	if wantsDetail(c) {
+		c.JSON(200, gin.H{"count": like_count})
+	} else {
+		c.String(200, strconv.Itoa(like_count))
+	}
+}
+
+func getLikeHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+
+		user_data := currentUser(c)
+
+		reaction, query_err := likedb.FindReaction(c.Request.Context(), target, user_data.Uid)
+		if query_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if query_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(query_err), gin.H{"reason": "find like error"})
+			return
+		}
+		if wantsDetail(c) {
+			version, find_err := likedb.FindVersion(c.Request.Context(), target, user_data.Uid)
+			if find_err != nil {
+				c.AbortWithStatusJSON(storageErrorStatus(find_err), gin.H{"reason": "find like error"})
+				return
+			}
+			c.Header("Like-Version", strconv.Itoa(version))
+			c.JSON(200, gin.H{"liked": reaction != "", "reaction": reaction, "version": version})
+		} else {
+			c.String(200, strconv.FormatBool(reaction != ""))
+		}
+
+	}
+}
+
+func createLikeHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+
+		user_data := currentUser(c)
+
+		new_like := models.Like{
+			Likeid:     primitive.NewObjectIDFromTimestamp(time.Now()),
+			Uid:        user_data.Uid,
+			Targettype: target.Type,
+			Targetid:   target.Id,
+			Reaction:   c.DefaultQuery("reaction", models.DEFAULT_REACTION),
+			Created:    time.Now(),
+		}
+
+		_, create_err := likedb.CreateLike(c.Request.Context(), new_like)
+		if create_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if create_err == models.ErrInvalidReaction {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid reaction"})
+			return
+		}
+		if create_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(create_err), gin.H{"reason": "create like error"})
+			return
+		}
+		c.String(200, "Liked")
+	}
+}
+
+func deleteLikeHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+
+		user_data := currentUser(c)
+
+		_, delete_err := likedb.DeleteLike(c.Request.Context(), target, user_data.Uid)
+		if delete_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if delete_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(delete_err), gin.H{"reason": "delete like error"})
+			return
+		}
+		c.String(200, "deleted")
+	}
+}
+
+// getStatesHandler answers for many targets of one type at once, each id
+// given as a repeated id parameter. Each state carries its id under the name
+// of that parameter, so /posts keeps answering with postid. Anonymous
+// clients get the counts, with nothing liked.
+func getStatesHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		targettype := params.targetType(c)
+		tagSpan(c, "target.type", targettype)
+
+		target_ids := c.QueryArray(params.IdParam)
+		uid := ""
+		if user_data := currentUser(c); user_data != nil {
+			uid = user_data.Uid
+		}
+
+		if len(target_ids) == 0 || len(target_ids) > MAX_BATCH_SIZE {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "between 1 and " + strconv.Itoa(MAX_BATCH_SIZE) + " " + params.IdParam + " required"})
+			return
+		}
+		if !validIds(c, targettype, params.IdParam, target_ids) {
+			return
+		}
+
+		states, find_err := likedb.FindStates(c.Request.Context(), targettype, target_ids, uid)
+		if find_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if find_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(find_err), gin.H{"reason": "find like states error"})
+			return
+		}
+
+		result := make([]gin.H, len(states))
+		for i, state := range states {
+			result[i] = gin.H{
+				params.IdParam: state.Targetid,
+				"count":        state.Count,
+				"liked":        state.Liked,
+			}
+			if state.Reaction != "" {
+				result[i]["reaction"] = state.Reaction
+			}
+		}
+		c.JSON(200, result)
+
+	}
+}
+
+func getLikersHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+
+		cursor, _ := c.GetQuery("cursor")
+
+		limit, limit_ok := pageLimit(c)
+		if !limit_ok {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid limit"})
+			return
+		}
+
+		likers, next, find_err := likedb.FindLikers(c.Request.Context(), target, cursor, limit)
+		if find_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if find_err == models.ErrInvalidCursor {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid cursor"})
+			return
+		}
+		if find_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(find_err), gin.H{"reason": "find likers error"})
+			return
+		}
+		c.JSON(200, gin.H{"likers": likers, "next": next})
+
+	}
+}
+
+func getUserLikeHandler(likedb models.LikeDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		user_data := currentUser(c)
+		target_type, _ := c.GetQuery("type")
+		cursor, _ := c.GetQuery("cursor")
+
+		limit, limit_ok := pageLimit(c)
+		if !limit_ok {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid limit"})
+			return
+		}
+
+		user_like, next, find_err := likedb.FindUserLike(c.Request.Context(), user_data.Uid, target_type, cursor, limit)
+		if find_err == models.ErrInvalidCursor {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid cursor"})
+			return
+		}
+		if find_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid type"})
+			return
+		}
+		if find_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(find_err), gin.H{"reason": "find user like error"})
+			return
+		}
+		c.JSON(200, gin.H{"likes": user_like, "next": next})
+
+	}
+}
+
+func internalCreateLikeHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+
+		uid, _ := c.GetQuery("uid")
+		tagSpan(c, "uid", uid)
+		if err := models.ValidUid(uid); err != nil {
+			abortInvalid(c, "uid", err)
+			return
+		}
+
+		new_like := models.Like{
+			Likeid:     primitive.NewObjectIDFromTimestamp(time.Now()),
+			Uid:        uid,
+			Targettype: target.Type,
+			Targetid:   target.Id,
+			Reaction:   c.DefaultQuery("reaction", models.DEFAULT_REACTION),
+			Created:    time.Now(),
+		}
+
+		_, create_err := likedb.CreateLike(c.Request.Context(), new_like)
+		if create_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if create_err == models.ErrInvalidReaction {
+			c.AbortWithStatusJSON(400, gin.H{"reason": "invalid reaction"})
+			return
+		}
+		if create_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(create_err), gin.H{"reason": "error create " + target.Type + " like"})
+			return
+		}
+		c.String(200, "Liked")
+	}
+}
+
+func reconcileCountHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+
+		like_count, reconcile_err := likedb.ReconcileCount(c.Request.Context(), target)
+		if reconcile_err == models.ErrInvalidTargetType {
+			c.AbortWithStatusJSON(404, gin.H{"reason": "unknown target type"})
+			return
+		}
+		if reconcile_err != nil {
+			c.AbortWithStatusJSON(storageErrorStatus(reconcile_err), gin.H{"reason": "error reconcile " + target.Type + " like count"})
+			return
+		}
+		c.String(200, strconv.Itoa(like_count))
+	}
+}
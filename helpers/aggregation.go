@@ -0,0 +1,60 @@
+package helpers
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Aggregation groups the documents a filter matches by the values of some
+// of their fields, and counts the documents of each group:
+//
+//	cursor, err := db.Aggregate(ctx, "like", Aggregation{
+//		Match:   Eq("targettype", "post"),
+//		GroupBy: []string{"targetid"},
+//		Sort:    []SortField{Desc("count")},
+//		Limit:   10,
+//	})
+//
+// The cursor returns a document per group, holding the fields grouped by,
+// which are missing for the documents without them, and the count of the
+// group as "count".
+type Aggregation struct {
+	Match Filter
+	// the top level fields grouped by, one group of every document when empty
+	GroupBy []string
+	// the order of the groups, by the fields grouped by or "count"
+	Sort []SortField
+	// how many groups to return at most, 0 for all
+	Limit int
+}
+
+// mongoPipeline translates an aggregation to a MongoDB pipeline, which
+// moves the fields grouped by out of the _id of the groups.
+func (aggregation Aggregation) mongoPipeline() bson.A {
+
+	var id interface{}
+	project := bson.D{{Key: "_id", Value: 0}, {Key: "count", Value: 1}}
+	if len(aggregation.GroupBy) != 0 {
+		keys := bson.D{}
+		for _, key := range aggregation.GroupBy {
+			keys = append(keys, bson.E{Key: key, Value: "$" + key})
+			project = append(project, bson.E{Key: key, Value: "$_id." + key})
+		}
+		id = keys
+	}
+
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: aggregation.Match.mongoFilter()}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: id},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$project", Value: project}},
+	}
+	if len(aggregation.Sort) != 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: mongoSort(aggregation.Sort)}})
+	}
+	if aggregation.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: aggregation.Limit}})
+	}
+	return pipeline
+}
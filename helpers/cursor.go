@@ -0,0 +1,150 @@
+package helpers
+
+import (
+	opentracing "github.com/opentracing/opentracing-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"context"
+)
+
+// Cursor streams the documents a query found, one at a time:
+//
+//	cursor, err := db.Find(ctx, "like", Eq("uid", uid), FindOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	defer cursor.Close(ctx)
+//	for cursor.Next(ctx) {
+//		like := Like{}
+//		if err := cursor.Decode(&like); err != nil {
+//			return err
+//		}
+//	}
+//	return cursor.Err()
+//
+// Closing the cursor before the last document stops the query early.
+type Cursor interface {
+	// Next moves to the next document, and reports false once there are
+	// none left or the query failed.
+	Next(context.Context) bool
+	// Decode copies the current document into the struct pointed to.
+	Decode(interface{}) error
+	// Err is why Next returned false, nil when the documents ran out.
+	Err() error
+	Close(context.Context) error
+}
+
+// SortField orders documents by a field, ascending unless Descending.
+type SortField struct {
+	Key        string
+	Descending bool
+}
+
+// FindOptions shape the documents a query returns. The zero value returns
+// every matching document in natural order.
+type FindOptions struct {
+	// the order of the documents, by the first field then the next
+	Sort []SortField
+	// how many documents to skip, and to return at most, 0 for all
+	Skip  int
+	Limit int
+	// how many documents a round trip fetches, 0 for the backend default
+	BatchSize int
+	// the fields returned, every field when empty; _id is always returned
+	Projection []string
+}
+
+// mongoSort translates sort fields to a MongoDB sort document.
+func mongoSort(fields []SortField) bson.D {
+	sort := bson.D{}
+	for _, field := range fields {
+		order := 1
+		if field.Descending {
+			order = -1
+		}
+		sort = append(sort, bson.E{Key: field.Key, Value: order})
+	}
+	return sort
+}
+
+func (opts FindOptions) mongoOptions() *options.FindOptions {
+	mongo_opts := options.Find()
+	if len(opts.Sort) != 0 {
+		mongo_opts.SetSort(mongoSort(opts.Sort))
+	}
+	if opts.Skip > 0 {
+		mongo_opts.SetSkip(int64(opts.Skip))
+	}
+	if opts.Limit > 0 {
+		mongo_opts.SetLimit(int64(opts.Limit))
+	}
+	if opts.BatchSize > 0 {
+		mongo_opts.SetBatchSize(int32(opts.BatchSize))
+	}
+	if len(opts.Projection) != 0 {
+		projection := bson.D{}
+		for _, key := range opts.Projection {
+			projection = append(projection, bson.E{Key: key, Value: 1})
+		}
+		mongo_opts.SetProjection(projection)
+	}
+	return mongo_opts
+}
+
+// mongoCursor classifies the errors of a driver cursor, and ends the span
+// and the timeout of its query when closed. Its round trips run with the
+// context of the query, so the timeout bounds the whole iteration.
+type mongoCursor struct {
+	cursor *mongo.Cursor
+	ctx    context.Context
+	cancel context.CancelFunc
+	span   opentracing.Span
+}
+
+func (cur *mongoCursor) Next(ctx context.Context) bool {
+	return cur.cursor.Next(cur.ctx)
+}
+
+func (cur *mongoCursor) Decode(v interface{}) error {
+	return cur.cursor.Decode(v)
+}
+
+func (cur *mongoCursor) Err() error {
+	return mongoError(cur.ctx, cur.cursor.Err())
+}
+
+func (cur *mongoCursor) Close(ctx context.Context) error {
+	defer cur.span.Finish()
+	defer cur.cancel()
+	return mongoError(ctx, cur.cursor.Close(ctx))
+}
+
+// memoryCursor walks documents a MemoryHelper copied out of a collection.
+type memoryCursor struct {
+	docs    []bson.M
+	current bson.M
+}
+
+func (cur *memoryCursor) Next(ctx context.Context) bool {
+	if len(cur.docs) == 0 {
+		cur.current = nil
+		return false
+	}
+	cur.current, cur.docs = cur.docs[0], cur.docs[1:]
+	return true
+}
+
+func (cur *memoryCursor) Decode(v interface{}) error {
+	return decode(cur.current, v)
+}
+
+func (cur *memoryCursor) Err() error {
+	return nil
+}
+
+func (cur *memoryCursor) Close(ctx context.Context) error {
+	cur.docs = nil
+	return nil
+}
@@ -0,0 +1,87 @@
+package helpers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"modernc.org/sqlite"
+)
+
+// The failures a DatabaseHelper reports, whatever its backend. The errors it
+// returns wrap one of these when the cause is known, so callers tell them
+// apart with errors.Is.
+var (
+	ErrNotFound    = errors.New("document not found")
+	ErrDuplicate   = errors.New("duplicate document")
+	ErrConflict    = errors.New("document changed")
+	ErrTimeout     = errors.New("database timeout")
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// mongoError classifies an error of the mongo driver. ctx is the context the
+// failed operation ran with, as the driver does not always return context
+// errors as such.
+func mongoError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	if isDuplicateKey(err) {
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	if command_err, ok := err.(mongo.CommandError); ok {
+		if command_err.IsMaxTimeMSExpiredError() {
+			return fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+		if command_err.HasErrorLabel("NetworkError") {
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+	}
+	if err == mongo.ErrClientDisconnected || strings.HasPrefix(err.Error(), "server selection error") {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+// sqlite result codes, see https://www.sqlite.org/rescode.html
+const (
+	sqlite_busy              = 5
+	sqlite_locked            = 6
+	sqlite_constraint_pk     = 1555
+	sqlite_constraint_unique = 2067
+)
+
+// SQLError classifies an error of the sqlite driver, as mongoError does for
+// MongoDB, for the storage written against database/sql.
+func SQLError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	var sqlite_err *sqlite.Error
+	if errors.As(err, &sqlite_err) {
+		switch sqlite_err.Code() & 0xff {
+		case sqlite_busy, sqlite_locked:
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		switch sqlite_err.Code() {
+		case sqlite_constraint_pk, sqlite_constraint_unique:
+			return fmt.Errorf("%w: %v", ErrDuplicate, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+package helpers
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"reflect"
+)
+
+type FilterOp string
+
+const (
+	OpAnd    FilterOp = "and"
+	OpOr     FilterOp = "or"
+	OpEq     FilterOp = "eq"
+	OpNe     FilterOp = "ne"
+	OpIn     FilterOp = "in"
+	OpLt     FilterOp = "lt"
+	OpLte    FilterOp = "lte"
+	OpGt     FilterOp = "gt"
+	OpGte    FilterOp = "gte"
+	OpExists FilterOp = "exists"
+)
+
+// Filter selects documents by their fields, named as stored, whatever the
+// backend. Filters are built with the functions below, for instance
+//
+//	And(Eq("uid", uid), In("targetid", "1", "2"), Gte("created", since))
+//
+// and each backend translates them to its own queries: MongoDBHelper to
+// BSON, other backends by walking Op, Key, Value, Values and Filters. Values
+// are compared the way MongoDB compares them, numbers with numbers, strings
+// with strings and so on; a value never matches one of another type. The
+// zero Filter matches every document.
+type Filter struct {
+	Op FilterOp
+	// the field compared, for every Op but OpAnd and OpOr
+	Key string
+	// the value compared with, or whether the field exists for OpExists
+	Value interface{}
+	// the values of OpIn
+	Values []interface{}
+	// the filters OpAnd and OpOr combine
+	Filters []Filter
+}
+
+// All matches every document.
+func All() Filter {
+	return Filter{Op: OpAnd}
+}
+
+func Eq(key string, value interface{}) Filter {
+	return Filter{Op: OpEq, Key: key, Value: value}
+}
+
+// Ne matches the documents whose key field differs from value, including
+// those without the field.
+func Ne(key string, value interface{}) Filter {
+	return Filter{Op: OpNe, Key: key, Value: value}
+}
+
+func In(key string, values ...interface{}) Filter {
+	return Filter{Op: OpIn, Key: key, Values: values}
+}
+
+// InStrings is In for a list of strings.
+func InStrings(key string, values []string) Filter {
+	in := make([]interface{}, len(values))
+	for i, value := range values {
+		in[i] = value
+	}
+	return In(key, in...)
+}
+
+func Lt(key string, value interface{}) Filter {
+	return Filter{Op: OpLt, Key: key, Value: value}
+}
+
+func Lte(key string, value interface{}) Filter {
+	return Filter{Op: OpLte, Key: key, Value: value}
+}
+
+func Gt(key string, value interface{}) Filter {
+	return Filter{Op: OpGt, Key: key, Value: value}
+}
+
+func Gte(key string, value interface{}) Filter {
+	return Filter{Op: OpGte, Key: key, Value: value}
+}
+
+func Exists(key string, exists bool) Filter {
+	return Filter{Op: OpExists, Key: key, Value: exists}
+}
+
+// And matches the documents every filter matches, all of them when there
+// are no filters.
+func And(filters ...Filter) Filter {
+	return Filter{Op: OpAnd, Filters: filters}
+}
+
+// Or matches the documents any filter matches, none when there are no
+// filters.
+func Or(filters ...Filter) Filter {
+	return Filter{Op: OpOr, Filters: filters}
+}
+
+// Asc and Desc sort by a field, for FindOptions.Sort.
+func Asc(key string) SortField {
+	return SortField{Key: key}
+}
+
+func Desc(key string) SortField {
+	return SortField{Key: key, Descending: true}
+}
+
+// mongoFilter translates filter to a MongoDB query document.
+func (filter Filter) mongoFilter() bson.D {
+
+	switch filter.Op {
+	case "", OpAnd:
+		switch len(filter.Filters) {
+		case 0:
+			return bson.D{}
+		case 1:
+			return filter.Filters[0].mongoFilter()
+		}
+		return bson.D{{Key: "$and", Value: mongoFilters(filter.Filters)}}
+	case OpOr:
+		if len(filter.Filters) == 0 {
+			return bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: bson.A{}}}}}
+		}
+		return bson.D{{Key: "$or", Value: mongoFilters(filter.Filters)}}
+	case OpEq:
+		return bson.D{{Key: filter.Key, Value: filter.Value}}
+	case OpIn:
+		return bson.D{{Key: filter.Key, Value: bson.D{{Key: "$in", Value: bson.A(filter.Values)}}}}
+	}
+	operator := "$" + string(filter.Op)
+	return bson.D{{Key: filter.Key, Value: bson.D{{Key: operator, Value: filter.Value}}}}
+}
+
+func mongoFilters(filters []Filter) bson.A {
+	translated := bson.A{}
+	for _, filter := range filters {
+		translated = append(translated, filter.mongoFilter())
+	}
+	return translated
+}
+
+// normalize converts a Go value to the one a document stores, such as an
+// int32 for a small int or a primitive.DateTime for a time.Time, so it
+// compares with the fields of decoded documents.
+func normalize(value interface{}) interface{} {
+	doc, err := toM(bson.M{"v": value})
+	if err != nil {
+		return value
+	}
+	return doc["v"]
+}
+
+// equalValues compares two normalized values, numbers by their value.
+func equalValues(a interface{}, b interface{}) bool {
+	if typeRank(a) != typeRank(b) {
+		return false
+	}
+	if typeRank(a) == rank_other {
+		return reflect.DeepEqual(a, b)
+	}
+	return compareValues(a, b) == 0
+}
+
+// matches reports whether filter matches doc, the way MongoDB would.
+func (filter Filter) matches(doc bson.M) bool {
+
+	switch filter.Op {
+	case "", OpAnd:
+		for _, and := range filter.Filters {
+			if !and.matches(doc) {
+				return false
+			}
+		}
+		return true
+	case OpOr:
+		for _, or := range filter.Filters {
+			if or.matches(doc) {
+				return true
+			}
+		}
+		return false
+	case OpExists:
+		_, present := lookupField(doc, filter.Key)
+		return present == filter.Value
+	}
+
+	field := lookup(doc, filter.Key)
+	switch filter.Op {
+	case OpEq:
+		return equalValues(field, normalize(filter.Value))
+	case OpNe:
+		return !equalValues(field, normalize(filter.Value))
+	case OpIn:
+		for _, value := range filter.Values {
+			if equalValues(field, normalize(value)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// ranges only compare values of the same type
+	value := normalize(filter.Value)
+	if field == nil || typeRank(field) != typeRank(value) || typeRank(field) == rank_other {
+		return false
+	}
+	order := compareValues(field, value)
+	switch filter.Op {
+	case OpLt:
+		return order < 0
+	case OpLte:
+		return order <= 0
+	case OpGt:
+		return order > 0
+	case OpGte:
+		return order >= 0
+	}
+	return false
+}
+
+// equalities returns the fields filter sets to a single value, which an
+// upsert inserting a document copies into it.
+func (filter Filter) equalities() bson.M {
+	fields := bson.M{}
+	switch filter.Op {
+	case OpEq:
+		fields[filter.Key] = normalize(filter.Value)
+	case "", OpAnd:
+		for _, and := range filter.Filters {
+			for key, value := range and.equalities() {
+				fields[key] = value
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,93 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFilterMatches(t *testing.T) {
+
+	now := time.Now()
+	doc, err := toM(testRecord{Recordid: primitive.NewObjectID(), Uid: "1", Count: 5, Created: now})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		filter  Filter
+		matches bool
+	}{
+		{Filter{}, true},
+		{Eq("uid", "1"), true},
+		{Eq("count", 5), true},
+		{Eq("count", int64(5)), true},
+		{Eq("count", 5.0), true},
+		// a value never matches one of another type
+		{Eq("count", "5"), false},
+		{Ne("uid", "2"), true},
+		{Ne("missing", "2"), true},
+		{Eq("missing", nil), true},
+		{InStrings("uid", []string{"2", "1"}), true},
+		{In("count", 1, 2), false},
+		{Gt("count", 4), true},
+		{Gte("count", 5), true},
+		{Lt("count", 5), false},
+		{Lte("count", 5), true},
+		{Gt("uid", 0), false},
+		{Gte("created", now.Add(-time.Minute)), true},
+		{Lt("created", now.Add(-time.Minute)), false},
+		{Exists("uid", true), true},
+		{Exists("missing", true), false},
+		{Exists("missing", false), true},
+		{And(Eq("uid", "1"), Gt("count", 1)), true},
+		{And(Eq("uid", "1"), Gt("count", 10)), false},
+		{Or(Eq("uid", "2"), Gt("count", 1)), true},
+		{Or(), false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.matches, c.filter.matches(doc), "%+v", c.filter)
+	}
+}
+
+func TestMongoFilter(t *testing.T) {
+
+	assert.Equal(t, bson.D{}, All().mongoFilter())
+	assert.Equal(t, bson.D{{Key: "uid", Value: "1"}}, And(Eq("uid", "1")).mongoFilter())
+	assert.Equal(t, bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "uid", Value: "1"}},
+		bson.D{{Key: "targetid", Value: bson.D{{Key: "$in", Value: bson.A{"a", "b"}}}}},
+		bson.D{{Key: "created", Value: bson.D{{Key: "$gte", Value: 1}}}},
+		bson.D{{Key: "reaction", Value: bson.D{{Key: "$exists", Value: false}}}},
+	}}}, And(Eq("uid", "1"), InStrings("targetid", []string{"a", "b"}), Gte("created", 1), Exists("reaction", false)).mongoFilter())
+	assert.Equal(t, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "uid", Value: bson.D{{Key: "$ne", Value: "1"}}}},
+		bson.D{{Key: "count", Value: bson.D{{Key: "$lt", Value: 2}}}},
+	}}}, Or(Ne("uid", "1"), Lt("count", 2)).mongoFilter())
+}
+
+func TestFilterEqualities(t *testing.T) {
+	filter := And(Eq("uid", "1"), And(Eq("count", 2)), Gt("created", 0), Or(Eq("name", "a")))
+	assert.Equal(t, bson.M{"uid": "1", "count": int32(2)}, filter.equalities())
+}
+
+func TestMongoPipeline(t *testing.T) {
+
+	pipeline := Aggregation{
+		Match:   Eq("targettype", "post"),
+		GroupBy: []string{"targetid"},
+		Sort:    []SortField{Desc("count")},
+		Limit:   10,
+	}.mongoPipeline()
+	assert.Equal(t, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "targettype", Value: "post"}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "targetid", Value: "$targetid"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "count", Value: 1}, {Key: "targetid", Value: "$_id.targetid"}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+		bson.D{{Key: "$limit", Value: 10}},
+	}, pipeline)
+}
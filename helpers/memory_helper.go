@@ -0,0 +1,705 @@
+package helpers
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryHelper is a DatabaseHelper keeping its collections in memory, for
+// local runs and tests. Documents are stored the way MongoDB stores them,
+// marshalled with their bson field names, and filters match those names
+// with MongoDB's semantics. Unique and TTL indexes are honoured too.
+type MemoryHelper struct {
+	lock        sync.RWMutex
+	collections map[string]*memoryCollection
+	now         func() time.Time
+}
+
+type memoryCollection struct {
+	// in insertion order, MongoDB's natural order on a fresh collection
+	docs    []bson.M
+	unique  [][]string
+	ttl_key string
+	ttl     time.Duration
+}
+
+func NewMemoryDatabase() DatabaseHelper {
+	return &MemoryHelper{
+		collections: map[string]*memoryCollection{},
+		now:         time.Now,
+	}
+}
+
+func (mem *MemoryHelper) collection(collectionName string) *memoryCollection {
+	coll, ok := mem.collections[collectionName]
+	if !ok {
+		coll = &memoryCollection{}
+		mem.collections[collectionName] = coll
+	}
+	return coll
+}
+
+// toM marshals v to a document the way the driver would.
+func toM(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// decode copies doc into obj, which must be a pointer.
+func decode(doc bson.M, obj interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, obj)
+}
+
+func copyM(doc bson.M) bson.M {
+	copied, _ := toM(doc)
+	return copied
+}
+
+// lookup returns the field at a dotted path of doc, nil when missing.
+func lookup(doc bson.M, path string) interface{} {
+	field, _ := lookupField(doc, path)
+	return field
+}
+
+// lookupField returns the field at a dotted path of doc, and whether doc
+// has it.
+func lookupField(doc bson.M, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	var current interface{} = doc
+	for _, part := range parts {
+		embedded, ok := current.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = embedded[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// add adds delta to the number at a dotted path of doc, creating the
+// embedded documents and the field as needed.
+func add(doc bson.M, path string, delta int64) error {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		embedded, ok := doc[part].(bson.M)
+		if !ok {
+			if doc[part] != nil {
+				return fmt.Errorf("field %s is not a document", part)
+			}
+			embedded = bson.M{}
+			doc[part] = embedded
+		}
+		doc = embedded
+	}
+	last := parts[len(parts)-1]
+	current, ok := toInt64(doc[last])
+	if !ok {
+		if doc[last] != nil {
+			return fmt.Errorf("field %s is not a number", path)
+		}
+		current = 0
+	}
+	sum := current + delta
+	// the driver stores an int that fits in 32 bits as int32
+	if sum >= math.MinInt32 && sum <= math.MaxInt32 {
+		doc[last] = int32(sum)
+	} else {
+		doc[last] = sum
+	}
+	return nil
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch number := value.(type) {
+	case int32:
+		return int64(number), true
+	case int64:
+		return number, true
+	case float64:
+		return int64(number), true
+	}
+	return 0, false
+}
+
+// expire drops the documents the TTL index of coll says are expired.
+func (mem *MemoryHelper) expire(coll *memoryCollection) {
+	if coll.ttl_key == "" {
+		return
+	}
+	deadline := mem.now().Add(-coll.ttl)
+	kept := coll.docs[:0]
+	for _, doc := range coll.docs {
+		created, ok := doc[coll.ttl_key].(primitive.DateTime)
+		if ok && created.Time().Before(deadline) {
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	coll.docs = kept
+}
+
+// find returns the index of every document matching filter, at most limit
+// of them when limit is positive.
+func (coll *memoryCollection) find(filter Filter, limit int) []int {
+	found := []int{}
+	for i, doc := range coll.docs {
+		if filter.matches(doc) {
+			found = append(found, i)
+			if limit > 0 && len(found) == limit {
+				break
+			}
+		}
+	}
+	return found
+}
+
+func (coll *memoryCollection) remove(i int) {
+	coll.docs = append(coll.docs[:i], coll.docs[i+1:]...)
+}
+
+// violates reports whether doc, about to be stored at index skip, or
+// appended when skip is -1, duplicates the _id or the unique index keys of
+// another document.
+func (coll *memoryCollection) violates(doc bson.M, skip int) bool {
+	indexes := append([][]string{{"_id"}}, coll.unique...)
+	for i, other := range coll.docs {
+		if i == skip {
+			continue
+		}
+		for _, keys := range indexes {
+			duplicate := true
+			for _, key := range keys {
+				if !reflect.DeepEqual(lookup(doc, key), lookup(other, key)) {
+					duplicate = false
+					break
+				}
+			}
+			if duplicate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// insert stores doc, generating its _id when it has none.
+func (coll *memoryCollection) insert(doc bson.M) error {
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	if coll.violates(doc, -1) {
+		return fmt.Errorf("%w: duplicate key", ErrDuplicate)
+	}
+	coll.docs = append(coll.docs, doc)
+	return nil
+}
+
+// replace stores doc in place of the document at index i.
+func (coll *memoryCollection) replace(i int, doc bson.M) error {
+	if coll.violates(doc, i) {
+		return fmt.Errorf("%w: duplicate key", ErrDuplicate)
+	}
+	coll.docs[i] = doc
+	return nil
+}
+
+// upsertDoc is the document an upsert matching nothing inserts: the fields
+// filter sets to a value, then those of data.
+func upsertDoc(filter Filter, data bson.M) bson.M {
+	doc := filter.equalities()
+	for key, value := range data {
+		doc[key] = value
+	}
+	return doc
+}
+
+// set overwrites the fields of doc with those of data, but for its _id.
+func set(doc bson.M, data bson.M) bson.M {
+	updated := copyM(doc)
+	for key, value := range data {
+		if key != "_id" {
+			updated[key] = value
+		}
+	}
+	return updated
+}
+
+func (mem *MemoryHelper) Query(ctx context.Context, collectionName string, filter Filter, data interface{}) error {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 1)
+	if len(found) == 0 {
+		return ErrNotFound
+	}
+	return decode(coll.docs[found[0]], data)
+}
+
+// find copies out the documents of a collection filter matches, shaped by
+// opts.
+func (mem *MemoryHelper) find(collectionName string, filter Filter, opts FindOptions) Cursor {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	docs := []bson.M{}
+	for _, doc := range coll.docs {
+		if filter.matches(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	sortDocs(docs, opts.Sort)
+	if opts.Skip >= len(docs) {
+		docs = nil
+	} else if opts.Skip > 0 {
+		docs = docs[opts.Skip:]
+	}
+	if opts.Limit > 0 && len(docs) > opts.Limit {
+		docs = docs[:opts.Limit]
+	}
+
+	copied := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		copied[i] = project(doc, opts.Projection)
+	}
+	return &memoryCursor{docs: copied}
+}
+
+// sortDocs orders docs by fields, keeping the order of the documents they
+// do not tell apart.
+func sortDocs(docs []bson.M, fields []SortField) {
+	if len(fields) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(a, b int) bool {
+		for _, field := range fields {
+			order := compareValues(lookup(docs[a], field.Key), lookup(docs[b], field.Key))
+			if field.Descending {
+				order = -order
+			}
+			if order != 0 {
+				return order < 0
+			}
+		}
+		return false
+	})
+}
+
+// project copies the fields of doc listed in keys, with its _id, or all its
+// fields when keys is empty.
+func project(doc bson.M, keys []string) bson.M {
+	copied := copyM(doc)
+	if len(keys) == 0 {
+		return copied
+	}
+	projected := bson.M{"_id": copied["_id"]}
+	for _, key := range keys {
+		if value, ok := copied[key]; ok {
+			projected[key] = value
+		}
+	}
+	return projected
+}
+
+// compareValues orders two field values the way MongoDB sorts them: by
+// type first, missing fields before numbers, strings, object ids, booleans
+// and dates, then by value.
+func compareValues(a interface{}, b interface{}) int {
+
+	if typeRank(a) != typeRank(b) {
+		if typeRank(a) < typeRank(b) {
+			return -1
+		}
+		return 1
+	}
+
+	switch a_value := a.(type) {
+	case int32, int64, float64:
+		a_number, _ := toFloat64(a)
+		b_number, _ := toFloat64(b)
+		if a_number < b_number {
+			return -1
+		}
+		if a_number > b_number {
+			return 1
+		}
+	case string:
+		return strings.Compare(a_value, b.(string))
+	case primitive.ObjectID:
+		b_value := b.(primitive.ObjectID)
+		return bytes.Compare(a_value[:], b_value[:])
+	case bool:
+		if a_value != b.(bool) {
+			if b.(bool) {
+				return -1
+			}
+			return 1
+		}
+	case primitive.DateTime:
+		if a_value < b.(primitive.DateTime) {
+			return -1
+		}
+		if a_value > b.(primitive.DateTime) {
+			return 1
+		}
+	}
+	return 0
+}
+
+const (
+	rank_missing = iota
+	rank_number
+	rank_string
+	rank_object_id
+	rank_bool
+	rank_date
+	rank_other
+)
+
+// typeRank is the place of the type of a value in the sort order.
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return rank_missing
+	case int32, int64, float64:
+		return rank_number
+	case string:
+		return rank_string
+	case primitive.ObjectID:
+		return rank_object_id
+	case bool:
+		return rank_bool
+	case primitive.DateTime:
+		return rank_date
+	}
+	return rank_other
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	if number, ok := value.(float64); ok {
+		return number, true
+	}
+	number, ok := toInt64(value)
+	return float64(number), ok
+}
+
+func (mem *MemoryHelper) Find(ctx context.Context, collectionName string, filter Filter, opts FindOptions) (Cursor, error) {
+	return mem.find(collectionName, filter, opts), nil
+}
+
+func (mem *MemoryHelper) Insert(ctx context.Context, collectionName string, data interface{}) error {
+
+	doc, err := toM(data)
+	if err != nil {
+		return err
+	}
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	return coll.insert(doc)
+}
+
+func (mem *MemoryHelper) Upsert(ctx context.Context, collectionName string, filter Filter, data interface{}) (bool, error) {
+
+	doc, err := toM(data)
+	if err != nil {
+		return false, err
+	}
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 1)
+	if len(found) == 0 {
+		return true, coll.insert(upsertDoc(filter, doc))
+	}
+	return false, coll.replace(found[0], set(coll.docs[found[0]], doc))
+}
+
+func (mem *MemoryHelper) FindAndUpsert(ctx context.Context, collectionName string, filter Filter, data interface{}, previous interface{}) (bool, error) {
+
+	doc, err := toM(data)
+	if err != nil {
+		return false, err
+	}
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 1)
+	if len(found) == 0 {
+		return false, coll.insert(upsertDoc(filter, doc))
+	}
+	if err := decode(coll.docs[found[0]], previous); err != nil {
+		return false, err
+	}
+	return true, coll.replace(found[0], set(coll.docs[found[0]], doc))
+}
+
+func (mem *MemoryHelper) Delete(ctx context.Context, collectionName string, filter Filter) (bool, error) {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 1)
+	if len(found) == 0 {
+		return false, nil
+	}
+	coll.remove(found[0])
+	return true, nil
+}
+
+func (mem *MemoryHelper) FindAndDelete(ctx context.Context, collectionName string, filter Filter, deleted interface{}) (bool, error) {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 1)
+	if len(found) == 0 {
+		return false, nil
+	}
+	if err := decode(coll.docs[found[0]], deleted); err != nil {
+		return false, err
+	}
+	coll.remove(found[0])
+	return true, nil
+}
+
+func (mem *MemoryHelper) DeleteAll(ctx context.Context, collectionName string, filter Filter) (int, error) {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	kept := coll.docs[:0]
+	deleted := 0
+	for _, doc := range coll.docs {
+		if filter.matches(doc) {
+			deleted++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	coll.docs = kept
+	return deleted, nil
+}
+
+func (mem *MemoryHelper) EnsureIndex(ctx context.Context, collectionName string, keys []string, unique bool) error {
+
+	if !unique {
+		return nil
+	}
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+
+	for _, index := range coll.unique {
+		if reflect.DeepEqual(index, keys) {
+			return nil
+		}
+	}
+	coll.unique = append(coll.unique, keys)
+	// like MongoDB, refuse an index the documents already break
+	for i, doc := range coll.docs {
+		if coll.violates(doc, i) {
+			coll.unique = coll.unique[:len(coll.unique)-1]
+			return fmt.Errorf("%w: duplicate key building index", ErrDuplicate)
+		}
+	}
+	return nil
+}
+
+func (mem *MemoryHelper) EnsureTTLIndex(ctx context.Context, collectionName string, key string, ttl time.Duration) error {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	coll.ttl_key = key
+	coll.ttl = ttl
+	return nil
+}
+
+func (mem *MemoryHelper) Increment(ctx context.Context, collectionName string, filter Filter, deltas map[string]int) error {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 1)
+	doc := upsertDoc(filter, bson.M{})
+	if len(found) != 0 {
+		doc = copyM(coll.docs[found[0]])
+	}
+	for field, delta := range deltas {
+		if err := add(doc, field, int64(delta)); err != nil {
+			return err
+		}
+	}
+	if len(found) == 0 {
+		return coll.insert(doc)
+	}
+	return coll.replace(found[0], doc)
+}
+
+func (mem *MemoryHelper) IncrementAll(ctx context.Context, collectionName string, filter Filter, deltas map[string]int) (int, error) {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 0)
+	for _, i := range found {
+		doc := copyM(coll.docs[i])
+		for field, delta := range deltas {
+			if err := add(doc, field, int64(delta)); err != nil {
+				return 0, err
+			}
+		}
+		if err := coll.replace(i, doc); err != nil {
+			return 0, err
+		}
+	}
+	return len(found), nil
+}
+
+func (mem *MemoryHelper) CompareAndIncrement(ctx context.Context, collectionName string, filter Filter, field string, expected int) (int, error) {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	found := coll.find(filter, 1)
+	doc := upsertDoc(filter, bson.M{})
+	if len(found) != 0 {
+		doc = copyM(coll.docs[found[0]])
+	}
+	current, _ := toInt64(lookup(doc, field))
+	if expected >= 0 && current != int64(expected) {
+		return 0, ErrConflict
+	}
+	if err := add(doc, field, 1); err != nil {
+		return 0, err
+	}
+	if len(found) == 0 {
+		if err := coll.insert(doc); err != nil {
+			return 0, err
+		}
+	} else if err := coll.replace(found[0], doc); err != nil {
+		return 0, err
+	}
+	return int(current + 1), nil
+}
+
+func (mem *MemoryHelper) Count(ctx context.Context, collectionName string, filter Filter) (int, error) {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	return len(coll.find(filter, 0)), nil
+}
+
+// Aggregate groups the documents in the order their groups first appear,
+// before sorting them.
+func (mem *MemoryHelper) Aggregate(ctx context.Context, collectionName string, aggregation Aggregation) (Cursor, error) {
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	coll := mem.collection(collectionName)
+	mem.expire(coll)
+
+	groups := []bson.M{}
+	counts := []int64{}
+	for _, i := range coll.find(aggregation.Match, 0) {
+		key := bson.M{}
+		for _, field := range aggregation.GroupBy {
+			if value, ok := coll.docs[i][field]; ok {
+				key[field] = value
+			}
+		}
+		found := -1
+		for g, group := range groups {
+			if sameGroup(group, key, aggregation.GroupBy) {
+				found = g
+				break
+			}
+		}
+		if found < 0 {
+			found = len(groups)
+			groups = append(groups, key)
+			counts = append(counts, 0)
+		}
+		counts[found]++
+	}
+
+	for g, group := range groups {
+		if counts[g] <= math.MaxInt32 {
+			group["count"] = int32(counts[g])
+		} else {
+			group["count"] = counts[g]
+		}
+		groups[g] = copyM(group)
+	}
+	sortDocs(groups, aggregation.Sort)
+	if aggregation.Limit > 0 && len(groups) > aggregation.Limit {
+		groups = groups[:aggregation.Limit]
+	}
+	return &memoryCursor{docs: groups}, nil
+}
+
+// sameGroup reports whether two groups have the same fields, with the same
+// values.
+func sameGroup(a bson.M, b bson.M, fields []string) bool {
+	for _, field := range fields {
+		a_value, a_ok := a[field]
+		b_value, b_ok := b[field]
+		if a_ok != b_ok || !equalValues(a_value, b_value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,284 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type testRecord struct {
+	Recordid primitive.ObjectID `bson:"_id, omitempty"`
+	Uid      string
+	Name     string
+	Count    int
+	Counts   map[string]int
+	Created  time.Time
+}
+
+func TestMemoryQueryMatchesBsonFieldNames(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: "1", Name: "a"}))
+
+	found := testRecord{}
+	assert.NoError(t, db.Query(ctx, "record", Eq("uid", "1"), &found))
+	assert.Equal(t, "a", found.Name)
+
+	// the Go field name, or a field under another name, matches nothing
+	assert.True(t, errors.Is(db.Query(ctx, "record", Eq("Uid", "1"), &found), ErrNotFound))
+	assert.True(t, errors.Is(db.Query(ctx, "record", Eq("userid", "1"), &found), ErrNotFound))
+	// and a string never matches a number
+	assert.True(t, errors.Is(db.Query(ctx, "record", Eq("count", "0"), &found), ErrNotFound))
+}
+
+// collect decodes every document of cursor, failing the test on an error.
+func collect(t *testing.T, cursor Cursor, err error) []testRecord {
+	assert.NoError(t, err)
+	defer cursor.Close(context.Background())
+	records := []testRecord{}
+	for cursor.Next(context.Background()) {
+		record := testRecord{}
+		assert.NoError(t, cursor.Decode(&record))
+		records = append(records, record)
+	}
+	assert.NoError(t, cursor.Err())
+	return records
+}
+
+func TestMemoryFind(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	for i, name := range []string{"b", "c", "a", "d"} {
+		uid := "1"
+		if name == "d" {
+			uid = "2"
+		}
+		assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: uid, Name: name, Count: i}))
+	}
+
+	cursor, err := db.Find(ctx, "record", Eq("uid", "1"), FindOptions{})
+	records := collect(t, cursor, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, "b", records[0].Name)
+
+	cursor, err = db.Find(ctx, "record", All(), FindOptions{
+		Sort:       []SortField{Desc("name")},
+		Skip:       1,
+		Limit:      2,
+		Projection: []string{"name"},
+	})
+	records = collect(t, cursor, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "c", records[0].Name)
+	assert.Equal(t, "b", records[1].Name)
+	// fields left out of the projection come back empty, but for _id
+	assert.Equal(t, "", records[0].Uid)
+	assert.False(t, records[0].Recordid.IsZero())
+
+	cursor, err = db.Find(ctx, "record", All(), FindOptions{Sort: []SortField{Asc("count")}, Skip: 10})
+	assert.Len(t, collect(t, cursor, err), 0)
+
+	cursor, err = db.Find(ctx, "empty", All(), FindOptions{})
+	assert.Len(t, collect(t, cursor, err), 0)
+
+	// a cursor closed early returns nothing more
+	cursor, err = db.Find(ctx, "record", All(), FindOptions{})
+	assert.NoError(t, err)
+	assert.True(t, cursor.Next(ctx))
+	assert.NoError(t, cursor.Close(ctx))
+	assert.False(t, cursor.Next(ctx))
+}
+
+func TestMemoryUniqueIndex(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	id := primitive.NewObjectID()
+	assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: id, Uid: "1"}))
+	assert.True(t, errors.Is(db.Insert(ctx, "record", testRecord{Recordid: id, Uid: "2"}), ErrDuplicate))
+
+	assert.NoError(t, db.EnsureIndex(ctx, "record", []string{"uid"}, true))
+	assert.True(t, errors.Is(db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: "1"}), ErrDuplicate))
+	assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: "2"}))
+
+	// an index the documents already break is refused
+	assert.True(t, errors.Is(db.EnsureIndex(ctx, "record", []string{"name"}, true), ErrDuplicate))
+}
+
+func TestMemoryUpsertAndDelete(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	query := Eq("uid", "1")
+	id := primitive.NewObjectID()
+
+	inserted, err := db.Upsert(ctx, "record", query, testRecord{Recordid: id, Uid: "1", Name: "a"})
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	inserted, err = db.Upsert(ctx, "record", query, testRecord{Recordid: primitive.NewObjectID(), Uid: "1", Name: "b"})
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+
+	// the upsert kept the _id it inserted with
+	found := testRecord{}
+	assert.NoError(t, db.Query(ctx, "record", query, &found))
+	assert.Equal(t, id, found.Recordid)
+	assert.Equal(t, "b", found.Name)
+	count, _ := db.Count(ctx, "record", All())
+	assert.Equal(t, 1, count)
+
+	previous := testRecord{}
+	existed, err := db.FindAndUpsert(ctx, "record", query, testRecord{Uid: "1", Name: "c"}, &previous)
+	assert.NoError(t, err)
+	assert.True(t, existed)
+	assert.Equal(t, "b", previous.Name)
+
+	deleted, err := db.Delete(ctx, "record", query)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = db.Delete(ctx, "record", query)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+}
+
+func TestMemoryIncrement(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	query := Eq("uid", "1")
+
+	assert.NoError(t, db.Increment(ctx, "record", query, map[string]int{"count": 1, "counts.love": 1}))
+	assert.NoError(t, db.Increment(ctx, "record", query, map[string]int{"count": 1, "counts.love": -1, "counts.sad": 1}))
+
+	found := testRecord{}
+	assert.NoError(t, db.Query(ctx, "record", query, &found))
+	assert.Equal(t, "1", found.Uid)
+	assert.Equal(t, 2, found.Count)
+	assert.Equal(t, map[string]int{"love": 0, "sad": 1}, found.Counts)
+
+	version, err := db.CompareAndIncrement(ctx, "version", query, "count", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	_, err = db.CompareAndIncrement(ctx, "version", query, "count", 0)
+	assert.True(t, errors.Is(err, ErrConflict))
+	version, err = db.CompareAndIncrement(ctx, "version", query, "count", -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+}
+
+func TestMemoryIncrementAll(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: "1", Count: 1}))
+	assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: "2", Count: 2}))
+
+	matched, err := db.IncrementAll(ctx, "record", Gt("count", 0), map[string]int{"count": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, matched)
+	found := testRecord{}
+	assert.NoError(t, db.Query(ctx, "record", Eq("uid", "2"), &found))
+	assert.Equal(t, 3, found.Count)
+
+	// nothing is created for a filter matching nothing
+	matched, err = db.IncrementAll(ctx, "record", Eq("uid", "3"), map[string]int{"count": -1})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, matched)
+	count, _ := db.Count(ctx, "record", All())
+	assert.Equal(t, 2, count)
+}
+
+func TestMemoryFindPage(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	ids := []primitive.ObjectID{}
+	for i := 0; i < 5; i++ {
+		id := primitive.NewObjectID()
+		ids = append(ids, id)
+		assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: id, Uid: "1"}))
+	}
+
+	page_opts := FindOptions{Sort: []SortField{Desc("_id")}, Limit: 2}
+	cursor, err := db.Find(ctx, "record", Eq("uid", "1"), page_opts)
+	page := collect(t, cursor, err)
+	assert.Len(t, page, 2)
+	assert.Equal(t, ids[4], page[0].Recordid)
+	assert.Equal(t, ids[3], page[1].Recordid)
+
+	cursor, err = db.Find(ctx, "record", And(Eq("uid", "1"), Lt("_id", ids[1])), page_opts)
+	page = collect(t, cursor, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, ids[0], page[0].Recordid)
+}
+
+func TestMemoryTTLIndex(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	mem := db.(*MemoryHelper)
+	now := time.Now()
+	mem.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	assert.NoError(t, db.EnsureTTLIndex(ctx, "record", "created", time.Hour))
+	assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: "1", Created: now}))
+
+	count, _ := db.Count(ctx, "record", Eq("uid", "1"))
+	assert.Equal(t, 1, count)
+	now = now.Add(2 * time.Hour)
+	count, _ = db.Count(ctx, "record", Eq("uid", "1"))
+	assert.Equal(t, 0, count)
+}
+
+type testGroup struct {
+	Uid   string
+	Count int
+}
+
+func TestMemoryAggregate(t *testing.T) {
+
+	db := NewMemoryDatabase()
+	ctx := context.Background()
+	for _, uid := range []string{"2", "1", "2", "3", "2", "1"} {
+		assert.NoError(t, db.Insert(ctx, "record", testRecord{Recordid: primitive.NewObjectID(), Uid: uid, Name: "a"}))
+	}
+	assert.NoError(t, db.Insert(ctx, "record", bson.M{"_id": primitive.NewObjectID(), "name": "b"}))
+
+	groups := func(aggregation Aggregation) []testGroup {
+		cursor, err := db.Aggregate(ctx, "record", aggregation)
+		assert.NoError(t, err)
+		defer cursor.Close(ctx)
+		found := []testGroup{}
+		for cursor.Next(ctx) {
+			group := testGroup{}
+			assert.NoError(t, cursor.Decode(&group))
+			found = append(found, group)
+		}
+		assert.NoError(t, cursor.Err())
+		return found
+	}
+
+	// documents without the field grouped by make a group of their own
+	assert.Equal(t, []testGroup{{"2", 3}, {"1", 2}, {"3", 1}, {"", 1}}, groups(Aggregation{GroupBy: []string{"uid"}}))
+	assert.Equal(t, []testGroup{{"3", 1}, {"2", 3}}, groups(Aggregation{
+		Match:   Eq("name", "a"),
+		GroupBy: []string{"uid"},
+		Sort:    []SortField{Desc("uid")},
+		Limit:   2,
+	}))
+	assert.Equal(t, []testGroup{{"1", 2}, {"2", 3}}, groups(Aggregation{
+		Match:   In("uid", "1", "2"),
+		GroupBy: []string{"uid"},
+		Sort:    []SortField{Asc("count")},
+	}))
+	// without fields to group by, every document is counted in one group
+	assert.Equal(t, []testGroup{{"", 7}}, groups(Aggregation{}))
+	assert.Len(t, groups(Aggregation{Match: Eq("uid", "4"), GroupBy: []string{"uid"}}), 0)
+}
@@ -1,6 +1,8 @@
 package helpers
 
 import (
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -9,17 +11,25 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"reflect"
 	"time"
 )
 
 type DatabaseHelper interface {
-	Query(string, map[string]string, interface{}) error
-	QueryAll(string, string, string, interface{}) ([]interface{}, error)
-	FindAll(string, interface{}) ([]interface{}, error)
-	Insert(string, interface{}) error
-	Upsert(string, map[string]string, interface{}) error
-	Delete(string, map[string]string) error
+	Query(context.Context, string, Filter, interface{}) error
+	Find(context.Context, string, Filter, FindOptions) (Cursor, error)
+	Insert(context.Context, string, interface{}) error
+	Upsert(context.Context, string, Filter, interface{}) (bool, error)
+	FindAndUpsert(context.Context, string, Filter, interface{}, interface{}) (bool, error)
+	Delete(context.Context, string, Filter) (bool, error)
+	FindAndDelete(context.Context, string, Filter, interface{}) (bool, error)
+	DeleteAll(context.Context, string, Filter) (int, error)
+	EnsureIndex(context.Context, string, []string, bool) error
+	EnsureTTLIndex(context.Context, string, string, time.Duration) error
+	Increment(context.Context, string, Filter, map[string]int) error
+	IncrementAll(context.Context, string, Filter, map[string]int) (int, error)
+	CompareAndIncrement(context.Context, string, Filter, string, int) (int, error)
+	Count(context.Context, string, Filter) (int, error)
+	Aggregate(context.Context, string, Aggregation) (Cursor, error)
 }
 
 type MongoDBHelper struct {
@@ -37,6 +47,30 @@ func toDoc(v interface{}) (doc *bson.D, err error) {
 	return
 }
 
+// splitID separates the _id of a document from the rest of its fields, as
+// updates may only set _id when they insert.
+func splitID(doc *bson.D) (bson.D, bson.D) {
+	fields := bson.D{}
+	id := bson.D{}
+	for _, e := range *doc {
+		if e.Key == "_id" {
+			id = append(id, e)
+		} else {
+			fields = append(fields, e)
+		}
+	}
+	return fields, id
+}
+
+// startSpan traces a database operation as a child of the span in ctx.
+func startSpan(ctx context.Context, operation string, collectionName string) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "mongodb "+operation)
+	ext.SpanKindRPCClient.Set(span)
+	ext.DBType.Set(span, "mongodb")
+	span.SetTag("db.collection", collectionName)
+	return span, ctx
+}
+
 func NewMongoDatabase() DatabaseHelper {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -55,148 +89,389 @@ func NewMongoDatabase() DatabaseHelper {
 	}
 }
 
-func (mdb *MongoDBHelper) Query(collectionName string, query map[string]string, data interface{}) error {
+func (mdb *MongoDBHelper) Query(ctx context.Context, collectionName string, filter Filter, data interface{}) error {
 
 	collection := mdb.db.Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	span, ctx := startSpan(ctx, "Query", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	result := collection.FindOne(ctx, query)
+	result := collection.FindOne(ctx, filter.mongoFilter())
 	err := result.Decode(data)
+	if err == mongo.ErrNoDocuments {
+		// not an error to log, callers ask for documents that may not exist
+		return mongoError(ctx, err)
+	}
 	if err != nil {
-		fmt.Println("helper mongodb : ", err)
-		return err
+		log.Print("helper mongodb query: ", err)
+		return mongoError(ctx, err)
 	}
 	return nil
 }
 
-func (mdb *MongoDBHelper) QueryAll(collectionName string, key string, value string, obj interface{}) ([]interface{}, error) {
+// find starts a query, whose span and timeout last until its cursor is
+// closed.
+func (mdb *MongoDBHelper) find(ctx context.Context, operation string, collectionName string, filter interface{}, opts FindOptions) (Cursor, error) {
 
 	collection := mdb.db.Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	span, ctx := startSpan(ctx, operation, collectionName)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 
-	cur, err := collection.Find(ctx, bson.M{key: value})
+	cur, err := collection.Find(ctx, filter, opts.mongoOptions())
 	if err != nil {
 		fmt.Println("finding fail ", err)
+		err = mongoError(ctx, err)
+		cancel()
+		span.Finish()
 		return nil, err
 	}
-	defer cur.Close(ctx)
+	return &mongoCursor{cursor: cur, ctx: ctx, cancel: cancel, span: span}, nil
+}
 
-	var container = make([]interface{}, 0)
-	for cur.Next(ctx) {
+// Find streams the documents matching filter.
+func (mdb *MongoDBHelper) Find(ctx context.Context, collectionName string, filter Filter, opts FindOptions) (Cursor, error) {
+	return mdb.find(ctx, "Find", collectionName, filter.mongoFilter(), opts)
+}
 
-		model := reflect.New(reflect.TypeOf(obj)).Interface()
-		decode_err := cur.Decode(model)
-		if decode_err != nil {
-			fmt.Println("decode fail ", decode_err)
-			return nil, decode_err
-		}
+// Aggregate streams the groups of an aggregation, run as a pipeline on the
+// server, which may spill to disk to group a whole collection.
+func (mdb *MongoDBHelper) Aggregate(ctx context.Context, collectionName string, aggregation Aggregation) (Cursor, error) {
+
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "Aggregate", collectionName)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 
-		fmt.Println("obj = ", obj)
-		fmt.Println("model = ", model)
-		md := reflect.ValueOf(model).Elem().Interface()
-		fmt.Println("md = ", md)
-		container = append(container, md)
-		fmt.Println("container = ", container)
+	cur, err := collection.Aggregate(ctx, aggregation.mongoPipeline(), options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		fmt.Println("aggregate fail ", err)
+		err = mongoError(ctx, err)
+		cancel()
+		span.Finish()
+		return nil, err
 	}
+	return &mongoCursor{cursor: cur, ctx: ctx, cancel: cancel, span: span}, nil
+}
 
-	return container, nil
+func (mdb *MongoDBHelper) Insert(ctx context.Context, collectionName string, data interface{}) error {
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "Insert", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	new_user, err := bson.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = collection.InsertOne(ctx, new_user)
+
+	if err != nil {
+		fmt.Println("Got a real error:", err.Error())
+		return mongoError(ctx, err)
+	}
+
+	return nil
 }
 
-func (mdb *MongoDBHelper) FindAll(collectionName string, obj interface{}) ([]interface{}, error) {
+// Upsert reports whether a new document was inserted, as opposed to an
+// existing one being updated.
+func (mdb *MongoDBHelper) Upsert(ctx context.Context, collectionName string, filter Filter, data interface{}) (bool, error) {
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "Upsert", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 
+	new_data, err := toDoc(data)
+	if err != nil {
+		return false, err
+	}
+	fields, id := splitID(new_data)
+	update := bson.D{{Key: "$set", Value: fields}}
+	if len(id) != 0 {
+		update = append(update, bson.E{Key: "$setOnInsert", Value: id})
+	}
+	opts := options.Update().SetUpsert(true)
+
+	result, err := collection.UpdateOne(ctx, filter.mongoFilter(), update, opts)
+	if err != nil {
+		return false, mongoError(ctx, err)
+	}
+
+	return result.UpsertedCount != 0, nil
+}
+
+// FindAndUpsert sets data on the document matching filter, inserting it when
+// there is none, and decodes the document as it was before into previous.
+// It reports whether there was a previous document.
+func (mdb *MongoDBHelper) FindAndUpsert(ctx context.Context, collectionName string, filter Filter, data interface{}, previous interface{}) (bool, error) {
 	collection := mdb.db.Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	span, ctx := startSpan(ctx, "FindAndUpsert", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	cur, err := collection.Find(ctx, bson.D{{}})
+	new_data, err := toDoc(data)
 	if err != nil {
-		fmt.Println("finding fail ", err)
-		return nil, err
+		return false, err
 	}
-	defer cur.Close(ctx)
+	fields, id := splitID(new_data)
+	update := bson.D{{Key: "$set", Value: fields}}
+	if len(id) != 0 {
+		update = append(update, bson.E{Key: "$setOnInsert", Value: id})
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
 
-	var container = make([]interface{}, 0)
-	for cur.Next(ctx) {
+	result := collection.FindOneAndUpdate(ctx, filter.mongoFilter(), update, opts)
+	if isDuplicateKey(result.Err()) {
+		// a concurrent upsert inserted the document first, so this
+		// attempt matches it
+		result = collection.FindOneAndUpdate(ctx, filter.mongoFilter(), update, opts)
+	}
+	err = result.Decode(previous)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		fmt.Println("helper mongodb : ", err)
+		return false, mongoError(ctx, err)
+	}
+	return true, nil
+}
 
-		model := reflect.New(reflect.TypeOf(obj)).Interface()
-		decode_err := cur.Decode(model)
-		if decode_err != nil {
-			fmt.Println("decode fail ", decode_err)
-			return nil, decode_err
-		}
+// CompareAndIncrement adds one to the numeric field of the document matching
+// filter and returns the new value, provided field holds expected. A missing
+// document holds 0 and is inserted. A negative expected increments whatever
+// the value. It fails with ErrConflict when field holds something else.
+// filter should match a unique index, so concurrent inserts conflict.
+func (mdb *MongoDBHelper) CompareAndIncrement(ctx context.Context, collectionName string, filter Filter, field string, expected int) (int, error) {
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "CompareAndIncrement", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 
-		fmt.Println("obj = ", obj)
-		fmt.Println("model = ", model)
-		md := reflect.ValueOf(model).Elem().Interface()
-		fmt.Println("md = ", md)
-		container = append(container, md)
-		fmt.Println("container = ", container)
+	if expected >= 0 {
+		filter = And(filter, Eq(field, expected))
 	}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: field, Value: 1}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(expected <= 0).SetReturnDocument(options.After)
 
-	return container, nil
+	result := collection.FindOneAndUpdate(ctx, filter.mongoFilter(), update, opts)
+	if expected < 0 && isDuplicateKey(result.Err()) {
+		// a concurrent upsert inserted the document first
+		result = collection.FindOneAndUpdate(ctx, filter.mongoFilter(), update, opts)
+	}
+	updated := bson.M{}
+	err := result.Decode(&updated)
+	if err == mongo.ErrNoDocuments || isDuplicateKey(err) {
+		return 0, ErrConflict
+	}
+	if err != nil {
+		fmt.Println("helper mongodb : ", err)
+		return 0, mongoError(ctx, err)
+	}
 
+	switch value := updated[field].(type) {
+	case int32:
+		return int(value), nil
+	case int64:
+		return int(value), nil
+	case float64:
+		return int(value), nil
+	}
+	return 0, fmt.Errorf("field %s is not a number", field)
 }
 
-func (mdb *MongoDBHelper) Insert(collectionName string, data interface{}) error {
+// Delete reports whether a document matched the filter and was removed.
+func (mdb *MongoDBHelper) Delete(ctx context.Context, collectionName string, filter Filter) (bool, error) {
+
 	collection := mdb.db.Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	span, ctx := startSpan(ctx, "Delete", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	new_user, err := bson.Marshal(data)
+	result, err := collection.DeleteOne(ctx, filter.mongoFilter())
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return false, mongoError(ctx, err)
 	}
-	_, err = collection.InsertOne(ctx, new_user)
 
+	return result.DeletedCount != 0, nil
+}
+
+// FindAndDelete removes the document matching filter and decodes it into
+// deleted. It reports whether there was a document to remove.
+func (mdb *MongoDBHelper) FindAndDelete(ctx context.Context, collectionName string, filter Filter, deleted interface{}) (bool, error) {
+
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "FindAndDelete", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	err := collection.FindOneAndDelete(ctx, filter.mongoFilter()).Decode(deleted)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
 	if err != nil {
-		fmt.Println("Got a real error:", err.Error())
-		return err
+		fmt.Println("helper mongodb : ", err)
+		return false, mongoError(ctx, err)
 	}
 
-	return err
+	return true, nil
 }
 
-func (mdb *MongoDBHelper) Upsert(collectionName string, query map[string]string, data interface{}) error {
+func (mdb *MongoDBHelper) DeleteAll(ctx context.Context, collectionName string, filter Filter) (int, error) {
+
 	collection := mdb.db.Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	span, ctx := startSpan(ctx, "DeleteAll", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	new_data, err := toDoc(data)
+	result, err := collection.DeleteMany(ctx, filter.mongoFilter())
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return 0, mongoError(ctx, err)
 	}
-	update := bson.D{{"$set", new_data}}
+
+	return int(result.DeletedCount), nil
+}
+
+// Increment atomically adds each delta to its field on the document matching
+// filter, creating the document if it does not exist yet.
+func (mdb *MongoDBHelper) Increment(ctx context.Context, collectionName string, filter Filter, deltas map[string]int) error {
+
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "Increment", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	inc := bson.M{}
+	for field, delta := range deltas {
+		inc[field] = delta
+	}
+	update := bson.D{{Key: "$inc", Value: inc}}
 	opts := options.Update().SetUpsert(true)
 
-	result, err := collection.UpdateOne(ctx, query, update, opts)
+	_, err := collection.UpdateOne(ctx, filter.mongoFilter(), update, opts)
 	if err != nil {
-		return err
+		fmt.Println("increment fail ", err)
+		return mongoError(ctx, err)
+	}
+
+	return nil
+}
+
+// IncrementAll atomically adds each delta to its field on every document
+// matching filter, creating none, and returns how many it matched.
+func (mdb *MongoDBHelper) IncrementAll(ctx context.Context, collectionName string, filter Filter, deltas map[string]int) (int, error) {
+
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "IncrementAll", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	inc := bson.M{}
+	for field, delta := range deltas {
+		inc[field] = delta
 	}
+	update := bson.D{{Key: "$inc", Value: inc}}
+
+	result, err := collection.UpdateMany(ctx, filter.mongoFilter(), update)
+	if err != nil {
+		fmt.Println("increment fail ", err)
+		return 0, mongoError(ctx, err)
+	}
+
+	return int(result.MatchedCount), nil
+}
+
+func (mdb *MongoDBHelper) Count(ctx context.Context, collectionName string, filter Filter) (int, error) {
+
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "Count", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, filter.mongoFilter())
+	if err != nil {
+		fmt.Println("count fail ", err)
+		return 0, mongoError(ctx, err)
+	}
+
+	return int(count), nil
+}
+
+// EnsureIndex creates an ascending compound index over keys, in order, if it
+// does not exist yet.
+func (mdb *MongoDBHelper) EnsureIndex(ctx context.Context, collectionName string, keys []string, unique bool) error {
+
+	collection := mdb.db.Collection(collectionName)
+	span, ctx := startSpan(ctx, "EnsureIndex", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 
-	if result.MatchedCount != 0 {
-		fmt.Println("matched and replaced an existing document")
-		return nil
+	index_keys := bson.D{}
+	for _, key := range keys {
+		index_keys = append(index_keys, bson.E{Key: key, Value: 1})
 	}
-	if result.UpsertedCount != 0 {
-		fmt.Printf("inserted a new document with ID %v\n", result.UpsertedID)
+	model := mongo.IndexModel{
+		Keys:    index_keys,
+		Options: options.Index().SetUnique(unique),
+	}
+
+	_, err := collection.Indexes().CreateOne(ctx, model)
+	if err != nil {
+		fmt.Println("create index fail ", err)
+		return mongoError(ctx, err)
 	}
 
 	return nil
 }
 
-func (mdb *MongoDBHelper) Delete(collectionName string, query map[string]string) error {
+// EnsureTTLIndex has the database remove documents once the time in their
+// key field is more than ttl ago. Removal runs periodically, so documents may
+// outlive ttl by a minute or so.
+func (mdb *MongoDBHelper) EnsureTTLIndex(ctx context.Context, collectionName string, key string, ttl time.Duration) error {
 
 	collection := mdb.db.Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	span, ctx := startSpan(ctx, "EnsureTTLIndex", collectionName)
+	defer span.Finish()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	_, err := collection.DeleteOne(ctx, query)
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: key, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(ttl.Seconds())),
+	}
+
+	_, err := collection.Indexes().CreateOne(ctx, model)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		fmt.Println("create ttl index fail ", err)
+		return mongoError(ctx, err)
 	}
 
 	return nil
 }
+
+func isDuplicateKey(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, write_err := range e.WriteErrors {
+			if write_err.Code == 11000 {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == 11000
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package helpers
+
+import (
+	"database/sql"
+	"log"
+
+	// registers the pure Go "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+// OpenSQLite opens the SQLite database file at path, ":memory:" for one
+// living as long as the process. SQLite serializes writes anyway, so the
+// pool is kept to a single connection: transactions then never fail on a
+// locked database, and an in-memory database is the same one for every
+// query.
+func OpenSQLite(path string) (*sql.DB, error) {
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	log.Print(path)
+
+	pragmas := []string{
+		"pragma journal_mode = wal",
+		"pragma synchronous = normal",
+	}
+	for _, pragma := range pragmas {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
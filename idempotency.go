@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vinhut/like-service/models"
+
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_IDEMPOTENCY_TTL = 24 * time.Hour
+	// well past the request timeout, so only crashed requests lose their key
+	DEFAULT_IDEMPOTENCY_LEASE  = time.Minute
+	MAX_IDEMPOTENCY_KEY_LENGTH = 255
+	// like bodies are a few bytes of JSON
+	MAX_IDEMPOTENT_BODY_SIZE = 16 << 10
+)
+
+var errBodyTooLarge = errors.New("body too large")
+
+// responseRecorder keeps a copy of the body written through it.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	recorder.body.Write(data)
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *responseRecorder) WriteString(data string) (int, error) {
+	recorder.body.WriteString(data)
+	return recorder.ResponseWriter.WriteString(data)
+}
+
+// requestFingerprint digests what a mutation does: its method, route,
+// target parameters and body. It fails with errBodyTooLarge for a body of
+// more than MAX_IDEMPOTENT_BODY_SIZE bytes.
+func requestFingerprint(c *gin.Context) (string, error) {
+	body := []byte{}
+	if c.Request.Body != nil {
+		var read_err error
+		body, read_err = ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MAX_IDEMPOTENT_BODY_SIZE))
+		if read_err != nil && len(body) >= MAX_IDEMPOTENT_BODY_SIZE {
+			return "", errBodyTooLarge
+		}
+		if read_err != nil {
+			return "", read_err
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	digest := sha256.New()
+	fmt.Fprintf(digest, "%s\n%s\n%s\n", c.Request.Method, c.Request.URL.Path, c.Request.URL.Query().Encode())
+	digest.Write(body)
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// idempotent replays the response to the first request a user made with an
+// Idempotency-Key header to later requests with the same key, so a client
+// retrying a like or unlike does not apply it twice. Reusing a key for
+// another request is a 422, and repeating it while the first is still being
+// handled a 409. A request that fails with a 5xx frees its key for the
+// retry. Requests without the header are handled as usual.
+func idempotent(idemdb models.IdempotencyDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > MAX_IDEMPOTENCY_KEY_LENGTH {
+			abortInvalid(c, "Idempotency-Key", models.ErrInvalidIdempotencyKey)
+			return
+		}
+		uid := currentUser(c).Uid
+		fingerprint, read_err := requestFingerprint(c)
+		if read_err == errBodyTooLarge {
+			abortError(c, 413, "body_too_large", "body too large")
+			return
+		}
+		if read_err != nil {
+			abortError(c, 400, "invalid_body", "unreadable body")
+			return
+		}
+
+		record, reserved, reserve_err := idemdb.Reserve(c.Request.Context(), uid, key, fingerprint)
+		if reserve_err != nil {
+			abortModelError(c, reserve_err)
+			return
+		}
+		if !reserved {
+			switch {
+			case record.Fingerprint != fingerprint:
+				abortError(c, 422, "idempotency_key_reused", "idempotency key used for another request")
+			case record.Status == 0:
+				abortError(c, 409, "request_in_progress", "request with this idempotency key in progress")
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(record.Status, record.ContentType, record.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// the request context may be done by now
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		status := recorder.Status()
+		if status >= 500 {
+			if release_err := idemdb.Release(ctx, uid, key, record); release_err != nil {
+				fmt.Println("idempotency key release error ", release_err)
+			}
+			return
+		}
+		record.Status = status
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.Body = recorder.body.Bytes()
+		if complete_err := idemdb.Complete(ctx, uid, key, record); complete_err != nil {
+			fmt.Println("idempotency key complete error ", complete_err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how far the timestamp of a signed internal request may be from our clock
+const MAX_SIGNATURE_SKEW = 5 * time.Minute
+
+// the internal routes take their parameters in the query, so signed bodies
+// are small
+const MAX_SIGNED_BODY_SIZE = 16 << 10
+
+// the gin context key the calling service is stored under
+const SERVICE_KEY = "service"
+
+// operations of the internal routes, granted to services by the ACL
+const (
+	OPERATION_CREATE    = "create"
+	OPERATION_RECONCILE = "reconcile"
+)
+
+// serviceRegistry holds the shared key of every service allowed to call
+// the internal routes, and which operations each may use. It remembers the
+// signatures it let through until their timestamps leave the skew window,
+// so a captured request cannot be replayed to this instance.
+type serviceRegistry struct {
+	keys map[string][]byte
+	acl  map[string]map[string]bool
+
+	lock       sync.Mutex
+	seen       map[string]time.Time
+	next_sweep time.Time
+}
+
+// newServiceRegistry reads keys as comma separated service=secret pairs and
+// acl as comma separated service:operation pairs, where the operation * is
+// every operation.
+func newServiceRegistry(keys string, acl string) (*serviceRegistry, error) {
+
+	registry := &serviceRegistry{
+		keys: map[string][]byte{},
+		acl:  map[string]map[string]bool{},
+		seen: map[string]time.Time{},
+	}
+	for _, pair := range strings.Split(keys, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		service_secret := strings.SplitN(pair, "=", 2)
+		if len(service_secret) != 2 || service_secret[1] == "" {
+			return nil, errors.New("internal service key must be service=secret")
+		}
+		registry.keys[strings.TrimSpace(service_secret[0])] = []byte(service_secret[1])
+	}
+	for _, pair := range strings.Split(acl, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		service_operation := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(service_operation) != 2 {
+			return nil, errors.New("internal service acl entry must be service:operation")
+		}
+		service, operation := service_operation[0], service_operation[1]
+		if registry.acl[service] == nil {
+			registry.acl[service] = map[string]bool{}
+		}
+		registry.acl[service][operation] = true
+	}
+	return registry, nil
+}
+
+func (registry *serviceRegistry) allowed(service string, operation string) bool {
+	return registry.acl[service][operation] || registry.acl[service]["*"]
+}
+
+// firstUse records the signature of service, signed at signed_at, and
+// reports whether it was not used before.
+func (registry *serviceRegistry) firstUse(service string, signature string, signed_at time.Time) bool {
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	now := time.Now()
+	if now.After(registry.next_sweep) {
+		for seen, expiry := range registry.seen {
+			if now.After(expiry) {
+				delete(registry.seen, seen)
+			}
+		}
+		registry.next_sweep = now.Add(MAX_SIGNATURE_SKEW)
+	}
+
+	key := service + "\n" + signature
+	if _, used := registry.seen[key]; used {
+		return false
+	}
+	registry.seen[key] = signed_at.Add(MAX_SIGNATURE_SKEW)
+	return true
+}
+
+// requestSignature is the hex HMAC-SHA256, under secret, of the method,
+// path, query, timestamp and body digest of a request, one per line.
+func requestSignature(secret []byte, method string, path string, query string, timestamp string, body []byte) string {
+	body_digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + query + "\n" + timestamp + "\n" + hex.EncodeToString(body_digest[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyService lets through requests signed by a registered service: the
+// X-Service-Name header names the service, X-Timestamp is the unix time
+// the request was signed at and X-Signature its requestSignature under the
+// key of the service. A signature is let through once.
+func verifyService(registry *serviceRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		service := c.GetHeader("X-Service-Name")
+		timestamp := c.GetHeader("X-Timestamp")
+		signature := c.GetHeader("X-Signature")
+		secret, known := registry.keys[service]
+		if !known || timestamp == "" || signature == "" {
+			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
+			return
+		}
+
+		signed_at, parse_err := strconv.ParseInt(timestamp, 10, 64)
+		skew := time.Since(time.Unix(signed_at, 0))
+		if parse_err != nil || skew > MAX_SIGNATURE_SKEW || skew < -MAX_SIGNATURE_SKEW {
+			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
+			return
+		}
+
+		body := []byte{}
+		if c.Request.Body != nil {
+			var read_err error
+			body, read_err = ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MAX_SIGNED_BODY_SIZE))
+			if read_err != nil && len(body) >= MAX_SIGNED_BODY_SIZE {
+				c.AbortWithStatusJSON(413, gin.H{"reason": "body too large"})
+				return
+			}
+			if read_err != nil {
+				c.AbortWithStatusJSON(400, gin.H{"reason": "unreadable body"})
+				return
+			}
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		expected := requestSignature(secret, c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery, timestamp, body)
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
+			return
+		}
+		if !registry.firstUse(service, expected, time.Unix(signed_at, 0)) {
+			c.AbortWithStatusJSON(401, gin.H{"reason": "replayed request"})
+			return
+		}
+
+		tagSpan(c, "service", service)
+		c.Set(SERVICE_KEY, service)
+		c.Next()
+	}
+}
+
+// allowOperation turns away services the ACL does not grant operation.
+func allowOperation(registry *serviceRegistry, operation string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !registry.allowed(c.GetString(SERVICE_KEY), operation) {
+			c.AbortWithStatusJSON(403, gin.H{"reason": "forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -2,19 +2,13 @@ package main
 
 import (
 	"github.com/gin-gonic/gin"
-	opentracing "github.com/opentracing/opentracing-go"
-	jaeger "github.com/uber/jaeger-client-go"
-	jaegercfg "github.com/uber/jaeger-client-go/config"
-	jaegerlog "github.com/uber/jaeger-client-go/log"
-	transport "github.com/uber/jaeger-client-go/transport/zipkin"
-	"github.com/uber/jaeger-client-go/zipkin"
-	"github.com/uber/jaeger-lib/metrics"
 	"github.com/vinhut/like-service/helpers"
 	"github.com/vinhut/like-service/models"
 	"github.com/vinhut/like-service/services"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"context"
 	"encoding/json"
+	"log"
 	"os"
 	"strconv"
 	"time"
@@ -22,6 +16,13 @@ import (
 
 var SERVICE_NAME = "like-service"
 
+const (
+	DEFAULT_REQUEST_TIMEOUT = 10 * time.Second
+	DEFAULT_PAGE_LIMIT      = 20
+	MAX_PAGE_LIMIT          = 100
+	MAX_BATCH_SIZE          = 100
+)
+
 type UserAuthData struct {
 	Uid     string
 	Email   string
@@ -29,367 +30,208 @@ type UserAuthData struct {
 	Created string
 }
 
-func checkUser(authservice services.AuthService, token string) (*UserAuthData, error) {
+// checkUser returns the user token belongs to. It fails with the errors of
+// services, and with services.ErrMalformedResponse when the user data the
+// auth service answered with has no uid.
+func checkUser(ctx context.Context, authservice services.AuthService, token string) (*UserAuthData, error) {
 
 	data := &UserAuthData{}
-	user_data, auth_error := authservice.Check(SERVICE_NAME, token)
+	user_data, auth_error := authservice.Check(ctx, SERVICE_NAME, token)
 	if auth_error != nil {
 		return data, auth_error
 	}
 
-	if err := json.Unmarshal([]byte(user_data), data); err != nil {
-		panic(err)
-		return data, err
+	if err := json.Unmarshal([]byte(user_data), data); err != nil || data.Uid == "" {
+		return data, services.ErrMalformedResponse
 	}
 
 	return data, nil
 
 }
 
-func setupRouter(likedb models.LikeDatabase, authservice services.AuthService) *gin.Engine {
-
-	var JAEGER_COLLECTOR_ENDPOINT = os.Getenv("JAEGER_COLLECTOR_ENDPOINT")
-	zipkinPropagator := zipkin.NewZipkinB3HTTPHeaderPropagator()
-	trsport, _ := transport.NewHTTPTransport(
-		JAEGER_COLLECTOR_ENDPOINT,
-		transport.HTTPLogger(jaeger.StdLogger),
-	)
-	cfg := jaegercfg.Configuration{
-		ServiceName: "like-service",
-		Sampler: &jaegercfg.SamplerConfig{
-			Type:  "const",
-			Param: 1,
-		},
-		Reporter: &jaegercfg.ReporterConfig{
-			LogSpans:          true,
-			CollectorEndpoint: JAEGER_COLLECTOR_ENDPOINT,
-		},
+// requestDeadline bounds the request context, which handlers pass down to
+// every storage query, so a slow query is cancelled along with the request.
+func requestDeadline(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
 	}
-	jLogger := jaegerlog.StdLogger
-	jMetricsFactory := metrics.NullFactory
-	cfg.InitGlobalTracer(
-		"like-service",
-		jaegercfg.Logger(jLogger),
-		jaegercfg.Metrics(jMetricsFactory),
-		jaegercfg.Injector(opentracing.HTTPHeaders, zipkinPropagator),
-		jaegercfg.Extractor(opentracing.HTTPHeaders, zipkinPropagator),
-		jaegercfg.ZipkinSharedRPCSpan(true),
-		jaegercfg.Reporter(jaeger.NewRemoteReporter(trsport)),
-	)
-	tracer := opentracing.GlobalTracer()
-
-	router := gin.Default()
-
-	router.GET("/ping", func(c *gin.Context) {
-		c.String(200, "OK")
-	})
-
-	router.GET(SERVICE_NAME+"/postcount", func(c *gin.Context) {
-
-		span := tracer.StartSpan("get postlike count")
-
-		value, cookie_err := c.Cookie("token")
-		post_id, _ := c.GetQuery("postid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "Unauthorized"})
-			return
-		}
-		_, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "Unauthorized"})
-			return
-		}
-
-		like_count, find_err := likedb.FindPost(post_id)
-		if find_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(404, gin.H{"reason": "like not found"})
-			return
-		}
-		c.String(200, strconv.Itoa(like_count))
-		span.Finish()
-
-	})
-
-	router.GET(SERVICE_NAME+"/post", func(c *gin.Context) {
-
-		span := tracer.StartSpan("get post like")
-
-		value, cookie_err := c.Cookie("token")
-		post_id, _ := c.GetQuery("postid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "Unauthorized"})
-			return
-		}
-
-		user_data, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "Unauthorized"})
-			return
-		}
-
-		isliked, query_err := likedb.PostIsLiked(post_id, user_data.Uid)
-		if query_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(404, gin.H{"reason": "like not found"})
-			return
-		}
-		c.String(200, strconv.FormatBool(isliked))
-		span.Finish()
-
-	})
-
-	router.POST(SERVICE_NAME+"/post", func(c *gin.Context) {
-		span := tracer.StartSpan("like post")
-
-		value, cookie_err := c.Cookie("token")
-		post_id, _ := c.GetQuery("postid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-		user_data, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-
-		new_post_like := models.PostLike{
-			Likeid:  primitive.NewObjectIDFromTimestamp(time.Now()),
-			Uid:     user_data.Uid,
-			Postid:  post_id,
-			Created: time.Now(),
-		}
-
-		_, create_err := likedb.CreatePostLike(new_post_like)
-		if create_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(500, gin.H{"reason": "create like error"})
-			return
-		}
-		c.String(200, "Liked")
-		span.Finish()
-	})
-
-	router.DELETE(SERVICE_NAME+"/post", func(c *gin.Context) {
-		span := tracer.StartSpan("unlike post")
-
-		value, cookie_err := c.Cookie("token")
-		post_id, _ := c.GetQuery("postid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-		user_data, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-
-		_, delete_err := likedb.DeletePostLike(post_id, user_data.Uid)
-		if delete_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(500, gin.H{"reason": "delete like error"})
-			return
-		}
-		c.String(200, "deleted")
-		span.Finish()
-	})
-
-	router.GET(SERVICE_NAME+"/commentcount", func(c *gin.Context) {
-
-		span := tracer.StartSpan("get comment like count")
-
-		value, cookie_err := c.Cookie("token")
-		comment_id, _ := c.GetQuery("commentid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-		_, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-
-		like_count, query_err := likedb.FindComment(comment_id)
-		if query_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(404, gin.H{"reason": "comment like not found"})
-			return
-		}
-		c.String(200, strconv.Itoa(like_count))
-		span.Finish()
-
-	})
-
-	router.GET(SERVICE_NAME+"/comment", func(c *gin.Context) {
-
-		span := tracer.StartSpan("get comment like")
-
-		value, cookie_err := c.Cookie("token")
-		comment_id, _ := c.GetQuery("commentid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-		user_data, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
+}
 
-		isLiked, query_err := likedb.CommentIsLiked(comment_id, user_data.Uid)
-		if query_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(404, gin.H{"reason": "comment like not found"})
-			return
-		}
-		c.String(200, strconv.FormatBool(isLiked))
-		span.Finish()
+func pageLimit(c *gin.Context) (int, bool) {
+	limit_str, ok := c.GetQuery("limit")
+	if !ok {
+		return DEFAULT_PAGE_LIMIT, true
+	}
+	limit, err := strconv.Atoi(limit_str)
+	if err != nil || limit < 1 || limit > MAX_PAGE_LIMIT {
+		return 0, false
+	}
+	return limit, true
+}
 
-	})
+// wantsDetail reports whether the client asked with ?detail=true for the
+// JSON response carrying reactions instead of the bare value older clients
+// expect.
+func wantsDetail(c *gin.Context) bool {
+	detail, _ := strconv.ParseBool(c.Query("detail"))
+	return detail
+}
 
-	router.POST(SERVICE_NAME+"/comment", func(c *gin.Context) {
-		span := tracer.StartSpan("like comment")
+func setupRouter(likedb models.LikeDatabase, idemdb models.IdempotencyDatabase, authservice services.AuthService) *gin.Engine {
 
-		value, cookie_err := c.Cookie("token")
-		comment_id, _ := c.GetQuery("commentid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-		user_data, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
+	tracer := initTracer()
 
-		new_comment_like := models.CommentLike{
+	request_timeout := DEFAULT_REQUEST_TIMEOUT
+	if timeout, err := time.ParseDuration(os.Getenv("REQUEST_TIMEOUT")); err == nil {
+		request_timeout = timeout
+	}
 
-			Likeid:    primitive.NewObjectIDFromTimestamp(time.Now()),
-			Uid:       user_data.Uid,
-			Commentid: comment_id,
-			Created:   time.Now(),
-		}
+	router := gin.Default()
+	router.Use(tracingMiddleware(tracer))
+	router.Use(requestDeadline(request_timeout))
 
-		_, create_err := likedb.CreateCommentLike(new_comment_like)
-		if create_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(500, gin.H{"reason": "create like error"})
-			return
-		}
-		c.String(200, "Liked")
-		span.Finish()
+	router.GET("/ping", func(c *gin.Context) {
+		c.String(200, "OK")
 	})
 
-	router.DELETE(SERVICE_NAME+"/comment", func(c *gin.Context) {
-		span := tracer.StartSpan("unlike comment")
-
-		value, cookie_err := c.Cookie("token")
-		comment_id, _ := c.GetQuery("commentid")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-		user_data, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-
-		_, delete_err := likedb.DeleteCommentLike(comment_id, user_data.Uid)
-		if delete_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(500, gin.H{"reason": "error delete like"})
-			return
-		}
-		c.String(200, "deleted")
-		span.Finish()
-	})
+	required := authenticate(authservice, auth_required)
+	optional := authenticate(authservice, auth_optional)
+	once := idempotent(idemdb)
+
+	valid := validTarget(generic_target)
+	router.GET(SERVICE_NAME+"/target/:type/count", optional, valid, getCountHandler(likedb, generic_target))
+	router.GET(SERVICE_NAME+"/target/:type/states", optional, getStatesHandler(likedb, generic_target))
+	router.GET(SERVICE_NAME+"/target/:type/likers", required, valid, getLikersHandler(likedb, generic_target))
+	router.GET(SERVICE_NAME+"/target/:type", required, valid, getLikeHandler(likedb, generic_target))
+	router.POST(SERVICE_NAME+"/target/:type", required, valid, once, createLikeHandler(likedb, generic_target))
+	router.DELETE(SERVICE_NAME+"/target/:type", required, valid, once, deleteLikeHandler(likedb, generic_target))
+	router.PUT(SERVICE_NAME+"/target/:type", required, valid, once, setStateHandler(likedb, generic_target))
+
+	// legacy routes, aliases of the target routes for posts and comments
+	for _, targettype := range []string{"post", "comment"} {
+		alias := aliasTarget(targettype)
+		valid_alias := validTarget(alias)
+		router.GET(SERVICE_NAME+"/"+targettype+"count", optional, valid_alias, getCountHandler(likedb, alias))
+		router.GET(SERVICE_NAME+"/"+targettype+"/likers", required, valid_alias, getLikersHandler(likedb, alias))
+		router.GET(SERVICE_NAME+"/"+targettype, required, valid_alias, getLikeHandler(likedb, alias))
+		router.POST(SERVICE_NAME+"/"+targettype, required, valid_alias, once, createLikeHandler(likedb, alias))
+		router.DELETE(SERVICE_NAME+"/"+targettype, required, valid_alias, once, deleteLikeHandler(likedb, alias))
+		router.PUT(SERVICE_NAME+"/"+targettype, required, valid_alias, once, setStateHandler(likedb, alias))
+	}
+	router.GET(SERVICE_NAME+"/posts", optional, getStatesHandler(likedb, aliasTarget("post")))
 
-	router.GET(SERVICE_NAME+"/user", func(c *gin.Context) {
+	router.GET(SERVICE_NAME+"/user", required, getUserLikeHandler(likedb))
 
-		span := tracer.StartSpan("get user like")
+	setupV2Routes(router, likedb, required, optional, once)
 
-		value, cookie_err := c.Cookie("token")
-		if cookie_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
-		user_data, check_err := checkUser(authservice, value)
-		if check_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(401, gin.H{"reason": "unauthorized"})
-			return
-		}
+	// internal endpoint, for the services of INTERNAL_SERVICE_KEYS as far as
+	// INTERNAL_SERVICE_ACL allows
 
-		user_like, find_err := likedb.FindUserLike(user_data.Uid)
-		if find_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(404, gin.H{"reason": "not found"})
-			return
-		}
-		result, marshal_err := json.Marshal(user_like)
-		if marshal_err != nil {
-			panic(marshal_err)
-		}
-		c.String(200, string(result))
-		span.Finish()
+	registry, registry_err := newServiceRegistry(os.Getenv("INTERNAL_SERVICE_KEYS"), os.Getenv("INTERNAL_SERVICE_ACL"))
+	if registry_err != nil {
+		log.Fatal("internal service registry fail ", registry_err)
+	}
+	create := allowOperation(registry, OPERATION_CREATE)
+	reconcile := allowOperation(registry, OPERATION_RECONCILE)
 
-	})
+	internal := router.Group("/internal", verifyService(registry))
+	internal.POST("/target/:type", create, valid, internalCreateLikeHandler(likedb, generic_target))
+	internal.POST("/target/:type/count", reconcile, valid, reconcileCountHandler(likedb, generic_target))
+	internal.POST("/post", create, validTarget(aliasTarget("post")), internalCreateLikeHandler(likedb, aliasTarget("post")))
+	internal.POST("/postcount", reconcile, validTarget(aliasTarget("post")), reconcileCountHandler(likedb, aliasTarget("post")))
+	internal.POST("/commentcount", reconcile, validTarget(aliasTarget("comment")), reconcileCountHandler(likedb, aliasTarget("comment")))
 
-	// internal endpoint
+	return router
+}
 
-	router.POST("internal/post", func(c *gin.Context) {
-		span := tracer.StartSpan("internal generate like post")
+func main() {
 
-		uid, _ := c.GetQuery("uid")
-		post_id, _ := c.GetQuery("postid")
+	// DATABASE_BACKEND picks the storage: mongodb, the default, sqlite for
+	// an embedded database in the file at SQLITE_PATH, or memory for local
+	// runs keeping everything in memory
+	var likedb models.LikeDatabase
+	var idemdb models.IdempotencyDatabase
+	var auditdb models.AuditDatabase
+	idempotency_ttl := DEFAULT_IDEMPOTENCY_TTL
+	if ttl, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil {
+		idempotency_ttl = ttl
+	}
+	idempotency_lease := DEFAULT_IDEMPOTENCY_LEASE
+	if lease, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_LEASE")); err == nil {
+		idempotency_lease = lease
+	}
+	switch os.Getenv("DATABASE_BACKEND") {
+	case "sqlite":
+		sqlite_path := os.Getenv("SQLITE_PATH")
+		if sqlite_path == "" {
+			sqlite_path = "like-service.db"
+		}
+		sql_db, open_err := helpers.OpenSQLite(sqlite_path)
+		if open_err != nil {
+			log.Fatal("open sqlite fail ", open_err)
+		}
+		migrated, migrate_err := models.MigrateSQL(context.Background(), sql_db)
+		if migrate_err != nil {
+			log.Fatal("migrate sqlite schema fail ", migrate_err)
+		}
+		log.Print("sqlite schema migrations applied: ", migrated)
+		likedb = models.NewSQLLikeDatabase(sql_db)
+		idemdb = models.NewSQLIdempotencyDatabase(sql_db, idempotency_ttl, idempotency_lease)
+		auditdb = models.NewSQLAuditDatabase(sql_db)
+	default:
+		var db_layer helpers.DatabaseHelper
+		if os.Getenv("DATABASE_BACKEND") == "memory" {
+			db_layer = helpers.NewMemoryDatabase()
+		} else {
+			db_layer = helpers.NewMongoDatabase()
+		}
+		likedb = models.NewLikeDatabase(db_layer)
+		idemdb = models.NewIdempotencyDatabase(db_layer, idempotency_ttl, idempotency_lease)
+		auditdb = models.NewAuditDatabase(db_layer)
+	}
 
-		new_post_like := models.PostLike{
-			Likeid:  primitive.NewObjectIDFromTimestamp(time.Now()),
-			Uid:     uid,
-			Postid:  post_id,
-			Created: time.Now(),
-		}
+	models.RegisterTargetTypes(os.Getenv("LIKE_TARGET_TYPES"))
+	if format_err := models.RegisterTargetIdFormats(os.Getenv("LIKE_TARGET_ID_FORMATS")); format_err != nil {
+		log.Fatal("target id formats fail ", format_err)
+	}
 
-		_, create_err := likedb.CreatePostLike(new_post_like)
-		if create_err != nil {
-			span.Finish()
-			c.AbortWithStatusJSON(500, gin.H{"reason": "error create post like"})
-			return
-		}
-		c.String(200, "Liked")
-		span.Finish()
-	})
+	// "like-service migrate" removes the duplicate likes that keep the unique
+	// indexes from being built, and copies the likes of the postlike and
+	// commentlike collections into the like collection; run it before
+	// serving from the like collection for the first time.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		removed, dedupe_err := likedb.DedupeLikes(context.Background())
+		if dedupe_err != nil {
+			log.Fatal("dedupe likes fail ", dedupe_err)
+		}
+		log.Print("removed duplicate likes: ", removed)
+		copied, migrate_err := likedb.MigrateLegacyLikes(context.Background())
+		if migrate_err != nil {
+			log.Fatal("migrate legacy likes fail ", migrate_err)
+		}
+		log.Print("migrated legacy likes: ", copied)
+		return
+	}
 
-	return router
-}
+	// the unique indexes keep likes, versions and idempotency keys single,
+	// serving without them is not safe
+	if index_err := likedb.EnsureIndexes(context.Background()); index_err != nil {
+		log.Fatal("ensure like indexes fail, run migrate first: ", index_err)
+	}
 
-func main() {
+	authservice, auth_err := services.NewAuthService()
+	if auth_err != nil {
+		log.Fatal("auth service setup fail ", auth_err)
+	}
+	if index_err := idemdb.EnsureIndexes(context.Background()); index_err != nil {
+		log.Fatal("ensure idempotency indexes fail: ", index_err)
+	}
 
-	mongo_layer := helpers.NewMongoDatabase()
-	likedb := models.NewLikeDatabase(mongo_layer)
-	authservice := services.NewUserAuthService()
-	router := setupRouter(likedb, authservice)
+	router := setupRouter(likedb, idemdb, authservice)
+	setupAdminRoutes(router, likedb, auditdb, authservice, adminRoles(os.Getenv("ADMIN_ROLES")))
 	router.Run(":8080")
 
 }
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/vinhut/like-service/helpers"
 	mocks_models "github.com/vinhut/like-service/mocks_models"
 	mocks_services "github.com/vinhut/like-service/mocks_services"
+	"github.com/vinhut/like-service/models"
+	"github.com/vinhut/like-service/services"
 
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,9 +29,10 @@ func TestPing(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/ping", nil)
@@ -42,9 +52,9 @@ func TestCheckUser(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
 
-	data, _ := checkUser(mock_auth, token)
+	data, _ := checkUser(context.Background(), mock_auth, token)
 	test_data := &UserAuthData{}
 
 	if err := json.Unmarshal([]byte(user_data), test_data); err != nil {
@@ -65,12 +75,13 @@ func TestGetPostLikeCount(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().FindPost(gomock.Any()).Return(1, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindCount(gomock.Any(), gomock.Any()).Return(1, map[string]int{"like": 1}, nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", SERVICE_NAME+"/postcount?postid="+postid, nil)
@@ -92,12 +103,13 @@ func TestGetPostLikeStatus(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().PostIsLiked(gomock.Any(), gomock.Any()).Return(true, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindReaction(gomock.Any(), gomock.Any(), gomock.Any()).Return("like", nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", SERVICE_NAME+"/post?postid="+postid, nil)
@@ -119,12 +131,13 @@ func TestCreatePostLike(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().CreatePostLike(gomock.Any()).Return(true, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).Return(true, nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", SERVICE_NAME+"/post?postid="+postid, nil)
@@ -146,12 +159,13 @@ func TestDeletePostLike(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().DeletePostLike(gomock.Any(), gomock.Any()).Return(true, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().DeleteLike(gomock.Any(), gomock.Any(), gomock.Any()).Return(true, nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("DELETE", SERVICE_NAME+"/post?postid="+postid, nil)
@@ -173,12 +187,13 @@ func TestGetCommentLikeCount(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().FindComment(gomock.Any()).Return(1, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindCount(gomock.Any(), gomock.Any()).Return(1, map[string]int{"like": 1}, nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", SERVICE_NAME+"/commentcount?commentid="+commentid, nil)
@@ -200,12 +215,13 @@ func TestGetCommentLikeStatus(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().CommentIsLiked(gomock.Any(), gomock.Any()).Return(true, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindReaction(gomock.Any(), gomock.Any(), gomock.Any()).Return("like", nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", SERVICE_NAME+"/comment?commentid="+commentid, nil)
@@ -227,12 +243,13 @@ func TestPostCommentLike(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().CreateCommentLike(gomock.Any()).Return(true, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).Return(true, nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", SERVICE_NAME+"/comment?commentid="+commentid, nil)
@@ -253,15 +270,16 @@ func TestGetUserLike(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().FindUserLike(gomock.Any()).Return(make([]string, 1), nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindUserLike(gomock.Any(), "1", "post", "", DEFAULT_PAGE_LIMIT).Return(make([]models.UserLike, 1), "", nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", SERVICE_NAME+"/user", nil)
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/user?type=post", nil)
 	req.Header.Set("Cookie", "token="+token+";")
 	router.ServeHTTP(w, req)
 
@@ -280,12 +298,13 @@ func TestDeleteCommentLike(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
 	mock_auth := mocks_services.NewMockAuthService(ctrl)
 
-	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any()).Return(user_data, nil)
-	mock_like.EXPECT().DeleteCommentLike(gomock.Any(), gomock.Any()).Return(true, nil)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().DeleteLike(gomock.Any(), gomock.Any(), gomock.Any()).Return(true, nil)
 
-	router := setupRouter(mock_like, mock_auth)
+	router := setupRouter(mock_like, mock_idem, mock_auth)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("DELETE", SERVICE_NAME+"/comment?commentid="+commentid, nil)
@@ -295,3 +314,1173 @@ func TestDeleteCommentLike(t *testing.T) {
 	assert.Equal(t, 200, w.Code)
 
 }
+
+func signInternal(req *http.Request, service string, secret string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Service-Name", service)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", requestSignature([]byte(secret), req.Method, req.URL.Path, req.URL.RawQuery, timestamp, nil))
+}
+
+func TestReconcilePostLikeCount(t *testing.T) {
+
+	postid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_like.EXPECT().ReconcileCount(gomock.Any(), models.Target{Type: "post", Id: postid}).Return(3, nil)
+
+	os.Setenv("INTERNAL_SERVICE_KEYS", "post-service=secret")
+	os.Setenv("INTERNAL_SERVICE_ACL", "post-service:reconcile")
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/internal/postcount?postid="+postid, nil)
+	signInternal(req, "post-service", "secret")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "3", w.Body.String())
+
+}
+
+func TestReconcileCommentLikeCount(t *testing.T) {
+
+	commentid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_like.EXPECT().ReconcileCount(gomock.Any(), models.Target{Type: "comment", Id: commentid}).Return(2, nil)
+
+	os.Setenv("INTERNAL_SERVICE_KEYS", "post-service=secret")
+	os.Setenv("INTERNAL_SERVICE_ACL", "post-service:reconcile")
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/internal/commentcount?commentid="+commentid, nil)
+	signInternal(req, "post-service", "secret")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "2", w.Body.String())
+
+}
+
+func TestGetPostLikers(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	postid := "1"
+	likers := []models.Liker{{Uid: "2", Created: now}}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindLikers(gomock.Any(), models.Target{Type: "post", Id: postid}, "", 10).Return(likers, "5e8f1d0a0000000000000000", nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/post/likers?postid="+postid+"&limit=10", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "\"next\":\"5e8f1d0a0000000000000000\"")
+
+}
+
+func TestGetCommentLikersInvalidLimit(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	commentid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/comment/likers?commentid="+commentid+"&limit=1000", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+
+}
+
+func TestGetPostLikeStates(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	states := []models.LikeState{
+		{Targetid: "1", Count: 4, Liked: true, Reaction: "like"},
+		{Targetid: "2", Count: 0, Liked: false},
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindStates(gomock.Any(), "post", []string{"1", "2"}, "1").Return(states, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/posts?postid=1&postid=2", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, "[{\"postid\":\"1\",\"count\":4,\"liked\":true,\"reaction\":\"like\"},{\"postid\":\"2\",\"count\":0,\"liked\":false}]", w.Body.String())
+
+}
+
+func TestGetUserLikeInvalidType(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindUserLike(gomock.Any(), "1", "story", "", DEFAULT_PAGE_LIMIT).Return(nil, "", models.ErrInvalidTargetType)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/user?type=story", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+
+}
+
+func TestGetPostLikeCountDetail(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	postid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindCount(gomock.Any(), models.Target{Type: "post", Id: postid}).Return(3, map[string]int{"like": 1, "love": 2}, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/postcount?postid="+postid+"&detail=true", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, "{\"count\":3,\"reactions\":{\"like\":1,\"love\":2}}", w.Body.String())
+
+}
+
+func TestGetPostLikeCountSince(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	postid := "1"
+	since := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil).Times(2)
+	mock_like.EXPECT().CountSince(gomock.Any(), models.Target{Type: "post", Id: postid}, since).Return(4, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/postcount?postid="+postid+"&since=2020-05-01T00:00:00Z", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "4", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", SERVICE_NAME+"/postcount?postid="+postid+"&since=yesterday", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+
+}
+
+func TestCreatePostReaction(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	postid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, like models.Like) (bool, error) {
+		assert.Equal(t, "post", like.Targettype)
+		assert.Equal(t, postid, like.Targetid)
+		assert.Equal(t, "laugh", like.Reaction)
+		return true, nil
+	})
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", SERVICE_NAME+"/post?postid="+postid+"&reaction=laugh", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+}
+
+func TestCreateTargetLike(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	storyid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, like models.Like) (bool, error) {
+		assert.Equal(t, "story", like.Targettype)
+		assert.Equal(t, storyid, like.Targetid)
+		assert.Equal(t, "1", like.Uid)
+		return true, nil
+	})
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", SERVICE_NAME+"/target/story?id="+storyid, nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+}
+
+func TestGetUnknownTargetLikeCount(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindCount(gomock.Any(), models.Target{Type: "album", Id: "1"}).Return(0, nil, models.ErrInvalidTargetType)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/target/album/count?id=1", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code)
+
+}
+
+func TestRequestContextHasDeadline(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	os.Setenv("REQUEST_TIMEOUT", "2s")
+	defer os.Unsetenv("REQUEST_TIMEOUT")
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindCount(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, target models.Target) (int, map[string]int, error) {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(2*time.Second), deadline, time.Second)
+		return 0, map[string]int{}, nil
+	})
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/postcount?postid=1", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+}
+
+func TestGetPostLikeStatusNotLiked(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	postid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindReaction(gomock.Any(), gomock.Any(), gomock.Any()).Return("", nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/post?postid="+postid, nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "false", w.Body.String())
+
+}
+
+func TestGetCommentLikeStatusUnavailable(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	commentid := "1"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindReaction(gomock.Any(), gomock.Any(), gomock.Any()).Return("", fmt.Errorf("%w: no reachable servers", helpers.ErrUnavailable))
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/comment?commentid="+commentid, nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 503, w.Code)
+
+}
+
+func TestTracingJoinsB3Trace(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	trace_id := "463ac35c9f6413ad"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindCount(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, target models.Target) (int, map[string]int, error) {
+		span := opentracing.SpanFromContext(ctx)
+		if assert.NotNil(t, span) {
+			assert.Equal(t, trace_id, span.Context().(jaeger.SpanContext).TraceID().String())
+		}
+		return 0, map[string]int{}, nil
+	})
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/postcount?postid=1", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	req.Header.Set("X-B3-TraceId", trace_id)
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+}
+
+func TestCheckUserMalformedResponse(t *testing.T) {
+
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return("", nil)
+
+	_, err := checkUser(context.Background(), mock_auth, token)
+
+	assert.Equal(t, services.ErrMalformedResponse, err)
+}
+
+func TestGetPostLikeCountAuthErrors(t *testing.T) {
+
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	gomock.InOrder(
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return("", services.ErrTokenExpired),
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return("", fmt.Errorf("%w: status 502", services.ErrUnavailable)),
+	)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/postcount?postid=1", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 503, w.Code)
+	assert.JSONEq(t, `{"reason":"auth service unavailable"}`, w.Body.String())
+
+}
+
+func TestGetPostLikeStatusBearerToken(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), token).Return(user_data, nil)
+	mock_like.EXPECT().FindReaction(gomock.Any(), models.Target{Type: "post", Id: "1"}, "1").Return("like", nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/post?postid=1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "true", w.Body.String())
+
+}
+
+func TestAnonymousReads(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_like.EXPECT().FindCount(gomock.Any(), models.Target{Type: "post", Id: "1"}).Return(3, map[string]int{"like": 3}, nil)
+	mock_like.EXPECT().FindStates(gomock.Any(), "post", []string{"1"}, "").Return([]models.LikeState{{Targetid: "1", Count: 3}}, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/postcount?postid=1", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "3", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", SERVICE_NAME+"/posts?postid=1", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `[{"postid":"1","count":3,"liked":false}]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", SERVICE_NAME+"/post?postid=1", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", SERVICE_NAME+"/postcount?postid=1", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 401, w.Code)
+
+}
+
+func TestAuthenticateRoles(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	admin_data := "{\"uid\": \"2\", \"email\": \"admin@email.com\", \"role\": \"admin\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	gomock.InOrder(
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil),
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(admin_data, nil),
+	)
+
+	router := gin.New()
+	router.GET("/admin", authenticate(mock_auth, authRoles("admin")), func(c *gin.Context) {
+		c.String(200, currentUser(c).Uid)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 403, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "2", w.Body.String())
+
+}
+
+func TestInternalCreateLikeServiceAuth(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).Return(true, nil)
+
+	os.Setenv("INTERNAL_SERVICE_KEYS", "post-service=secret,feed-service=other")
+	os.Setenv("INTERNAL_SERVICE_ACL", "post-service:*,feed-service:reconcile")
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	// unsigned
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/internal/post?postid=1&uid=1", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	// signed with the wrong key
+	w = httptest.NewRecorder()
+	signInternal(req, "post-service", "other")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	// signed for another query
+	w = httptest.NewRecorder()
+	signInternal(req, "post-service", "secret")
+	req.URL.RawQuery = "postid=1&uid=2"
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	// not granted by the acl
+	w = httptest.NewRecorder()
+	signInternal(req, "feed-service", "other")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	w = httptest.NewRecorder()
+	signInternal(req, "post-service", "secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+}
+
+func TestInternalRequestReplayed(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).Return(true, nil).Times(1)
+
+	os.Setenv("INTERNAL_SERVICE_KEYS", "post-service=secret")
+	os.Setenv("INTERNAL_SERVICE_ACL", "post-service:*")
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/internal/post?postid=1&uid=1", nil)
+	signInternal(req, "post-service", "secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	// a body over the limit is not read to the end
+	body := strings.Repeat("x", MAX_SIGNED_BODY_SIZE+1)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/internal/post?postid=1&uid=1", strings.NewReader(body))
+	req.Header.Set("X-Service-Name", "post-service")
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", requestSignature([]byte("secret"), "POST", "/internal/post", "postid=1&uid=1", timestamp, []byte(body)))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 413, w.Code)
+
+}
+
+func TestAdminDeleteUserLikes(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	admin_data := "{\"uid\": \"2\", \"email\": \"admin@email.com\", \"role\": \"moderator\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_audit := mocks_models.NewMockAuditDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	gomock.InOrder(
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil),
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(admin_data, nil),
+	)
+	gomock.InOrder(
+		mock_audit.EXPECT().Record(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, record models.AuditRecord) error {
+			assert.Equal(t, "2", record.Actor)
+			assert.Equal(t, "delete user likes", record.Action)
+			assert.Equal(t, "1", record.Uid)
+			return nil
+		}),
+		mock_like.EXPECT().DeleteUserLikes(gomock.Any(), "1").Return(4, nil),
+	)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+	setupAdminRoutes(router, mock_like, mock_audit, mock_auth, adminRoles("admin,moderator"))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", SERVICE_NAME+"/admin/user/1/likes", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 403, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"deleted":4}`, w.Body.String())
+
+}
+
+func TestAdminDebugVars(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	admin_data := "{\"uid\": \"2\", \"email\": \"admin@email.com\", \"role\": \"admin\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_audit := mocks_models.NewMockAuditDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	gomock.InOrder(
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil),
+		mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(admin_data, nil),
+	)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+	setupAdminRoutes(router, mock_like, mock_audit, mock_auth, adminRoles(""))
+
+	// not on the public routes
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/debug/vars", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", SERVICE_NAME+"/admin/debug/vars", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 401, w.Code)
+
+	req.Header.Set("Cookie", "token="+token+";")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 403, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "memstats")
+
+}
+
+func TestAdminActionNotAuditedNotDone(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	admin_data := "{\"uid\": \"2\", \"email\": \"admin@email.com\", \"role\": \"admin\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_audit := mocks_models.NewMockAuditDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(admin_data, nil)
+	mock_audit.EXPECT().Record(gomock.Any(), gomock.Any()).Return(fmt.Errorf("%w: no reachable servers", helpers.ErrUnavailable))
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+	setupAdminRoutes(router, mock_like, mock_audit, mock_auth, adminRoles(""))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", SERVICE_NAME+"/admin/target/post?id=1", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 503, w.Code)
+
+}
+
+func TestV2GetTargetState(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	liked_at := time.Date(2020, 7, 26, 15, 21, 10, 0, time.UTC)
+	target := models.Target{Type: "post", Id: "1"}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().FindCount(gomock.Any(), target).Return(2, map[string]int{"like": 1, "love": 1}, nil)
+	mock_like.EXPECT().FindLike(gomock.Any(), target, "1").Return(models.Like{Uid: "1", Targettype: "post", Targetid: "1", Reaction: "love", Created: liked_at}, true, nil)
+	mock_like.EXPECT().FindVersion(gomock.Any(), target, "1").Return(4, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", SERVICE_NAME+"/v2/target/post/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "4", w.Header().Get("Like-Version"))
+	assert.JSONEq(t, `{"target":{"type":"post","id":"1"},"count":2,"reactions":{"like":1,"love":1},"liked":true,"reaction":"love","liked_at":"2020-07-26T15:21:10Z","version":4}`, w.Body.String())
+
+}
+
+func TestV2CreateLike(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	target := models.Target{Type: "comment", Id: "5"}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, like models.Like) (bool, error) {
+		assert.Equal(t, "1", like.Uid)
+		assert.Equal(t, "comment", like.Targettype)
+		assert.Equal(t, "5", like.Targetid)
+		assert.Equal(t, "laugh", like.Reaction)
+		return true, nil
+	})
+	mock_like.EXPECT().FindCount(gomock.Any(), target).Return(1, map[string]int{"laugh": 1}, nil)
+	mock_like.EXPECT().FindLike(gomock.Any(), target, "1").Return(models.Like{Reaction: "laugh", Created: now}, true, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", SERVICE_NAME+"/v2/target/comment/5/like", strings.NewReader(`{"reaction":"laugh"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	state := TargetState{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+	assert.Equal(t, target, state.Target)
+	assert.Equal(t, 1, state.Count)
+	assert.True(t, state.Liked)
+	assert.Equal(t, "laugh", state.Reaction)
+	assert.NotNil(t, state.LikedAt)
+
+}
+
+func TestV2RepeatedLikeKeepsLikedAt(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	target := models.Target{Type: "post", Id: "1"}
+	liked_at := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil).Times(2)
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).Return(true, nil).Times(2)
+	mock_like.EXPECT().FindCount(gomock.Any(), target).Return(1, map[string]int{"like": 1}, nil).Times(2)
+	mock_like.EXPECT().FindLike(gomock.Any(), target, "1").Return(models.Like{Reaction: "like", Created: liked_at}, true, nil).Times(2)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", SERVICE_NAME+"/v2/target/post/1/like", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		state := TargetState{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+		assert.NotNil(t, state.LikedAt)
+		assert.True(t, liked_at.Equal(*state.LikedAt))
+	}
+
+}
+
+func TestV2ErrorEnvelope(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_like.EXPECT().FindCount(gomock.Any(), models.Target{Type: "story", Id: "1"}).Return(0, nil, models.ErrInvalidTargetType)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", SERVICE_NAME+"/v2/target/post/1/like", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 401, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"unauthorized","message":"unauthorized"}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", SERVICE_NAME+"/v2/target/story/1", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 404, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"unknown_target_type","message":"unknown target type"}}`, w.Body.String())
+
+}
+
+func TestCreatePostLikeValidation(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil).Times(4)
+
+	assert.NoError(t, models.RegisterTargetIdFormats("comment=^[0-9]+$"))
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", SERVICE_NAME+"/post", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"reason":"missing postid","field":"postid"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", SERVICE_NAME+"/comment?commentid=abc", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"reason":"invalid commentid","field":"commentid"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", SERVICE_NAME+"/posts?postid=1&postid="+strings.Repeat("a", models.MAX_TARGET_ID_LENGTH+1), nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"reason":"invalid postid","field":"postid"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", SERVICE_NAME+"/v2/target/comment/abc/like", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"invalid_argument","message":"invalid id","field":"id"}}`, w.Body.String())
+
+}
+
+func TestInternalCreateLikeMissingUid(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	os.Setenv("INTERNAL_SERVICE_KEYS", "post-service=secret")
+	os.Setenv("INTERNAL_SERVICE_ACL", "post-service:create")
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/internal/post?postid=1", nil)
+	signInternal(req, "post-service", "secret")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"reason":"missing uid","field":"uid"}`, w.Body.String())
+
+}
+
+func TestCreatePostLikeIdempotencyKey(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	stored := models.IdempotencyRecord{}
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil).Times(3)
+	gomock.InOrder(
+		mock_idem.EXPECT().Reserve(gomock.Any(), "1", "retry-1", gomock.Any()).DoAndReturn(func(ctx context.Context, uid string, key string, fingerprint string) (models.IdempotencyRecord, bool, error) {
+			return models.IdempotencyRecord{Uid: uid, Key: key, Fingerprint: fingerprint}, true, nil
+		}),
+		mock_idem.EXPECT().Complete(gomock.Any(), "1", "retry-1", gomock.Any()).DoAndReturn(func(ctx context.Context, uid string, key string, record models.IdempotencyRecord) error {
+			stored = record
+			return nil
+		}),
+		mock_idem.EXPECT().Reserve(gomock.Any(), "1", "retry-1", gomock.Any()).DoAndReturn(func(ctx context.Context, uid string, key string, fingerprint string) (models.IdempotencyRecord, bool, error) {
+			return stored, false, nil
+		}).Times(2),
+	)
+	mock_like.EXPECT().CreateLike(gomock.Any(), gomock.Any()).Return(true, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", SERVICE_NAME+"/post?postid=1", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	req.Header.Set("Idempotency-Key", "retry-1")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "Liked", w.Body.String())
+	assert.Equal(t, 200, stored.Status)
+	assert.Equal(t, "Liked", string(stored.Body))
+
+	// the retry gets the stored response without liking again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "Liked", w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+	// the same key for another post is turned away
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", SERVICE_NAME+"/post?postid=2", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	req.Header.Set("Idempotency-Key", "retry-1")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 422, w.Code)
+
+}
+
+func TestIdempotencyKeyBodyTooLarge(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"reaction":"` + strings.Repeat("a", MAX_IDEMPOTENT_BODY_SIZE) + `"}`)
+	req, _ := http.NewRequest("POST", SERVICE_NAME+"/v2/target/post/1/like", body)
+	req.Header.Set("Cookie", "token="+token+";")
+	req.Header.Set("Idempotency-Key", "retry-1")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 413, w.Code)
+
+}
+
+func TestSetPostLikeState(t *testing.T) {
+
+	now := time.Now()
+	token := "852a37a34b727c0e0b331806-7af4bdfdcc60990d427f383efecc8529289d040dd67e0753b9e2ee5a1e938402186f28324df23f6faa4e2bbf43f584ae228c55b00143866215d6e92805d470a1cc2a096dcca4d43527598122313be412e17fbefdcdab2fae02e06a405791d936862d4fba688b3c7fd784d4"
+	user_data := "{\"uid\": \"1\", \"email\": \"test@email.com\", \"role\": \"standard\", \"created\": \"" + now.Format("2006-01-02T15:04:05") + "\"}"
+	target := models.Target{Type: "post", Id: "1"}
+	liked_at := now.Add(-time.Hour)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock_like := mocks_models.NewMockLikeDatabase(ctrl)
+	mock_idem := mocks_models.NewMockIdempotencyDatabase(ctrl)
+	mock_auth := mocks_services.NewMockAuthService(ctrl)
+
+	mock_auth.EXPECT().Check(gomock.Any(), gomock.Any(), gomock.Any()).Return(user_data, nil).Times(3)
+	gomock.InOrder(
+		mock_like.EXPECT().SetLike(gomock.Any(), gomock.Any(), true, 2).DoAndReturn(func(ctx context.Context, like models.Like, liked bool, expected int) (int, error) {
+			assert.Equal(t, "1", like.Uid)
+			assert.Equal(t, "post", like.Targettype)
+			assert.Equal(t, "love", like.Reaction)
+			return 3, nil
+		}),
+		mock_like.EXPECT().FindCount(gomock.Any(), target).Return(4, map[string]int{"like": 3, "love": 1}, nil),
+		// the like existed before, so it keeps its time
+		mock_like.EXPECT().FindLike(gomock.Any(), target, "1").Return(models.Like{Reaction: "love", Created: liked_at}, true, nil),
+		mock_like.EXPECT().SetLike(gomock.Any(), gomock.Any(), false, 2).Return(3, models.ErrVersionConflict),
+	)
+
+	router := setupRouter(mock_like, mock_idem, mock_auth)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", SERVICE_NAME+"/post?postid=1&liked=true&reaction=love&version=2", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	response := SetStateResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 3, response.Version)
+	assert.Equal(t, 4, response.Count)
+	assert.True(t, response.Liked)
+	assert.Equal(t, "love", response.Reaction)
+	assert.True(t, liked_at.Equal(*response.LikedAt))
+
+	// a second tap made with the same version conflicts
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", SERVICE_NAME+"/v2/target/post/1/like", strings.NewReader(`{"liked":false,"version":2}`))
+	req.Header.Set("Cookie", "token="+token+";")
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 409, w.Code)
+	assert.Equal(t, "3", w.Header().Get("Like-Version"))
+	assert.JSONEq(t, `{"error":{"code":"version_conflict","message":"version conflict"}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", SERVICE_NAME+"/post?postid=1", nil)
+	req.Header.Set("Cookie", "token="+token+";")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"reason":"missing liked","field":"liked"}`, w.Body.String())
+
+}
@@ -0,0 +1,49 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: models/audit.go
+
+// Package mock_models is a generated GoMock package.
+package mocks_models
+
+import (
+	context "context"
+	gomock "github.com/golang/mock/gomock"
+	models "github.com/vinhut/like-service/models"
+	reflect "reflect"
+)
+
+// MockAuditDatabase is a mock of AuditDatabase interface
+type MockAuditDatabase struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuditDatabaseMockRecorder
+}
+
+// MockAuditDatabaseMockRecorder is the mock recorder for MockAuditDatabase
+type MockAuditDatabaseMockRecorder struct {
+	mock *MockAuditDatabase
+}
+
+// NewMockAuditDatabase creates a new mock instance
+func NewMockAuditDatabase(ctrl *gomock.Controller) *MockAuditDatabase {
+	mock := &MockAuditDatabase{ctrl: ctrl}
+	mock.recorder = &MockAuditDatabaseMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockAuditDatabase) EXPECT() *MockAuditDatabaseMockRecorder {
+	return m.recorder
+}
+
+// Record mocks base method
+func (m *MockAuditDatabase) Record(arg0 context.Context, arg1 models.AuditRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Record", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Record indicates an expected call of Record
+func (mr *MockAuditDatabaseMockRecorder) Record(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Record", reflect.TypeOf((*MockAuditDatabase)(nil).Record), arg0, arg1)
+}
@@ -0,0 +1,93 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: models/idempotency.go
+
+// Package mock_models is a generated GoMock package.
+package mocks_models
+
+import (
+	context "context"
+	gomock "github.com/golang/mock/gomock"
+	models "github.com/vinhut/like-service/models"
+	reflect "reflect"
+)
+
+// MockIdempotencyDatabase is a mock of IdempotencyDatabase interface
+type MockIdempotencyDatabase struct {
+	ctrl     *gomock.Controller
+	recorder *MockIdempotencyDatabaseMockRecorder
+}
+
+// MockIdempotencyDatabaseMockRecorder is the mock recorder for MockIdempotencyDatabase
+type MockIdempotencyDatabaseMockRecorder struct {
+	mock *MockIdempotencyDatabase
+}
+
+// NewMockIdempotencyDatabase creates a new mock instance
+func NewMockIdempotencyDatabase(ctrl *gomock.Controller) *MockIdempotencyDatabase {
+	mock := &MockIdempotencyDatabase{ctrl: ctrl}
+	mock.recorder = &MockIdempotencyDatabaseMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockIdempotencyDatabase) EXPECT() *MockIdempotencyDatabaseMockRecorder {
+	return m.recorder
+}
+
+// Reserve mocks base method
+func (m *MockIdempotencyDatabase) Reserve(arg0 context.Context, arg1, arg2, arg3 string) (models.IdempotencyRecord, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Reserve", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(models.IdempotencyRecord)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Reserve indicates an expected call of Reserve
+func (mr *MockIdempotencyDatabaseMockRecorder) Reserve(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reserve", reflect.TypeOf((*MockIdempotencyDatabase)(nil).Reserve), arg0, arg1, arg2, arg3)
+}
+
+// Complete mocks base method
+func (m *MockIdempotencyDatabase) Complete(arg0 context.Context, arg1, arg2 string, arg3 models.IdempotencyRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Complete", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Complete indicates an expected call of Complete
+func (mr *MockIdempotencyDatabaseMockRecorder) Complete(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Complete", reflect.TypeOf((*MockIdempotencyDatabase)(nil).Complete), arg0, arg1, arg2, arg3)
+}
+
+// Release mocks base method
+func (m *MockIdempotencyDatabase) Release(arg0 context.Context, arg1, arg2 string, arg3 models.IdempotencyRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Release", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Release indicates an expected call of Release
+func (mr *MockIdempotencyDatabaseMockRecorder) Release(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*MockIdempotencyDatabase)(nil).Release), arg0, arg1, arg2, arg3)
+}
+
+// EnsureIndexes mocks base method
+func (m *MockIdempotencyDatabase) EnsureIndexes(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnsureIndexes", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnsureIndexes indicates an expected call of EnsureIndexes
+func (mr *MockIdempotencyDatabaseMockRecorder) EnsureIndexes(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureIndexes", reflect.TypeOf((*MockIdempotencyDatabase)(nil).EnsureIndexes), arg0)
+}
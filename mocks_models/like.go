@@ -5,9 +5,11 @@
 package mocks_models
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	models "github.com/vinhut/like-service/models"
 	reflect "reflect"
+	time "time"
 )
 
 // MockLikeDatabase is a mock of LikeDatabase interface
@@ -33,137 +35,275 @@ func (m *MockLikeDatabase) EXPECT() *MockLikeDatabaseMockRecorder {
 	return m.recorder
 }
 
-// FindPost mocks base method
-func (m *MockLikeDatabase) FindPost(arg0 string) (int, error) {
+// FindCount mocks base method
+func (m *MockLikeDatabase) FindCount(arg0 context.Context, arg1 models.Target) (int, map[string]int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindPost", arg0)
+	ret := m.ctrl.Call(m, "FindCount", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(map[string]int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// FindCount indicates an expected call of FindCount
+func (mr *MockLikeDatabaseMockRecorder) FindCount(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindCount", reflect.TypeOf((*MockLikeDatabase)(nil).FindCount), arg0, arg1)
+}
+
+// CountSince mocks base method
+func (m *MockLikeDatabase) CountSince(arg0 context.Context, arg1 models.Target, arg2 time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountSince", arg0, arg1, arg2)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// FindPost indicates an expected call of FindPost
-func (mr *MockLikeDatabaseMockRecorder) FindPost(arg0 interface{}) *gomock.Call {
+// CountSince indicates an expected call of CountSince
+func (mr *MockLikeDatabaseMockRecorder) CountSince(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindPost", reflect.TypeOf((*MockLikeDatabase)(nil).FindPost), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountSince", reflect.TypeOf((*MockLikeDatabase)(nil).CountSince), arg0, arg1, arg2)
 }
 
-// PostIsLiked mocks base method
-func (m *MockLikeDatabase) PostIsLiked(arg0, arg1 string) (bool, error) {
+// CountByTarget mocks base method
+func (m *MockLikeDatabase) CountByTarget(arg0 context.Context, arg1 string, arg2 []string) (map[string]int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "PostIsLiked", arg0, arg1)
-	ret0, _ := ret[0].(bool)
+	ret := m.ctrl.Call(m, "CountByTarget", arg0, arg1, arg2)
+	ret0, _ := ret[0].(map[string]int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountByTarget indicates an expected call of CountByTarget
+func (mr *MockLikeDatabaseMockRecorder) CountByTarget(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountByTarget", reflect.TypeOf((*MockLikeDatabase)(nil).CountByTarget), arg0, arg1, arg2)
+}
+
+// FindReaction mocks base method
+func (m *MockLikeDatabase) FindReaction(arg0 context.Context, arg1 models.Target, arg2 string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindReaction", arg0, arg1, arg2)
+	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// PostIsLiked indicates an expected call of PostIsLiked
-func (mr *MockLikeDatabaseMockRecorder) PostIsLiked(arg0, arg1 interface{}) *gomock.Call {
+// FindReaction indicates an expected call of FindReaction
+func (mr *MockLikeDatabaseMockRecorder) FindReaction(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PostIsLiked", reflect.TypeOf((*MockLikeDatabase)(nil).PostIsLiked), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindReaction", reflect.TypeOf((*MockLikeDatabase)(nil).FindReaction), arg0, arg1, arg2)
 }
 
-// CreatePostLike mocks base method
-func (m *MockLikeDatabase) CreatePostLike(arg0 models.PostLike) (bool, error) {
+// FindLike mocks base method
+func (m *MockLikeDatabase) FindLike(arg0 context.Context, arg1 models.Target, arg2 string) (models.Like, bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreatePostLike", arg0)
+	ret := m.ctrl.Call(m, "FindLike", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.Like)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// FindLike indicates an expected call of FindLike
+func (mr *MockLikeDatabaseMockRecorder) FindLike(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindLike", reflect.TypeOf((*MockLikeDatabase)(nil).FindLike), arg0, arg1, arg2)
+}
+
+// CreateLike mocks base method
+func (m *MockLikeDatabase) CreateLike(arg0 context.Context, arg1 models.Like) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateLike", arg0, arg1)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CreatePostLike indicates an expected call of CreatePostLike
-func (mr *MockLikeDatabaseMockRecorder) CreatePostLike(arg0 interface{}) *gomock.Call {
+// CreateLike indicates an expected call of CreateLike
+func (mr *MockLikeDatabaseMockRecorder) CreateLike(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePostLike", reflect.TypeOf((*MockLikeDatabase)(nil).CreatePostLike), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateLike", reflect.TypeOf((*MockLikeDatabase)(nil).CreateLike), arg0, arg1)
 }
 
-// DeletePostLike mocks base method
-func (m *MockLikeDatabase) DeletePostLike(arg0, arg1 string) (bool, error) {
+// DeleteLike mocks base method
+func (m *MockLikeDatabase) DeleteLike(arg0 context.Context, arg1 models.Target, arg2 string) (bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeletePostLike", arg0, arg1)
+	ret := m.ctrl.Call(m, "DeleteLike", arg0, arg1, arg2)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// DeletePostLike indicates an expected call of DeletePostLike
-func (mr *MockLikeDatabaseMockRecorder) DeletePostLike(arg0, arg1 interface{}) *gomock.Call {
+// DeleteLike indicates an expected call of DeleteLike
+func (mr *MockLikeDatabaseMockRecorder) DeleteLike(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeletePostLike", reflect.TypeOf((*MockLikeDatabase)(nil).DeletePostLike), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteLike", reflect.TypeOf((*MockLikeDatabase)(nil).DeleteLike), arg0, arg1, arg2)
 }
 
-// FindComment mocks base method
-func (m *MockLikeDatabase) FindComment(arg0 string) (int, error) {
+// SetLike mocks base method
+func (m *MockLikeDatabase) SetLike(arg0 context.Context, arg1 models.Like, arg2 bool, arg3 int) (int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindComment", arg0)
+	ret := m.ctrl.Call(m, "SetLike", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// FindComment indicates an expected call of FindComment
-func (mr *MockLikeDatabaseMockRecorder) FindComment(arg0 interface{}) *gomock.Call {
+// SetLike indicates an expected call of SetLike
+func (mr *MockLikeDatabaseMockRecorder) SetLike(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindComment", reflect.TypeOf((*MockLikeDatabase)(nil).FindComment), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLike", reflect.TypeOf((*MockLikeDatabase)(nil).SetLike), arg0, arg1, arg2, arg3)
 }
 
-// CommentIsLiked mocks base method
-func (m *MockLikeDatabase) CommentIsLiked(arg0, arg1 string) (bool, error) {
+// FindVersion mocks base method
+func (m *MockLikeDatabase) FindVersion(arg0 context.Context, arg1 models.Target, arg2 string) (int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CommentIsLiked", arg0, arg1)
-	ret0, _ := ret[0].(bool)
+	ret := m.ctrl.Call(m, "FindVersion", arg0, arg1, arg2)
+	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CommentIsLiked indicates an expected call of CommentIsLiked
-func (mr *MockLikeDatabaseMockRecorder) CommentIsLiked(arg0, arg1 interface{}) *gomock.Call {
+// FindVersion indicates an expected call of FindVersion
+func (mr *MockLikeDatabaseMockRecorder) FindVersion(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CommentIsLiked", reflect.TypeOf((*MockLikeDatabase)(nil).CommentIsLiked), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindVersion", reflect.TypeOf((*MockLikeDatabase)(nil).FindVersion), arg0, arg1, arg2)
 }
 
-// CreateCommentLike mocks base method
-func (m *MockLikeDatabase) CreateCommentLike(arg0 models.CommentLike) (bool, error) {
+// FindStates mocks base method
+func (m *MockLikeDatabase) FindStates(arg0 context.Context, arg1 string, arg2 []string, arg3 string) ([]models.LikeState, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateCommentLike", arg0)
-	ret0, _ := ret[0].(bool)
+	ret := m.ctrl.Call(m, "FindStates", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]models.LikeState)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CreateCommentLike indicates an expected call of CreateCommentLike
-func (mr *MockLikeDatabaseMockRecorder) CreateCommentLike(arg0 interface{}) *gomock.Call {
+// FindStates indicates an expected call of FindStates
+func (mr *MockLikeDatabaseMockRecorder) FindStates(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateCommentLike", reflect.TypeOf((*MockLikeDatabase)(nil).CreateCommentLike), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindStates", reflect.TypeOf((*MockLikeDatabase)(nil).FindStates), arg0, arg1, arg2, arg3)
 }
 
-// DeleteCommentLike mocks base method
-func (m *MockLikeDatabase) DeleteCommentLike(arg0, arg1 string) (bool, error) {
+// FindLikers mocks base method
+func (m *MockLikeDatabase) FindLikers(arg0 context.Context, arg1 models.Target, arg2 string, arg3 int) ([]models.Liker, string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteCommentLike", arg0, arg1)
-	ret0, _ := ret[0].(bool)
+	ret := m.ctrl.Call(m, "FindLikers", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]models.Liker)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// FindLikers indicates an expected call of FindLikers
+func (mr *MockLikeDatabaseMockRecorder) FindLikers(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindLikers", reflect.TypeOf((*MockLikeDatabase)(nil).FindLikers), arg0, arg1, arg2, arg3)
+}
+
+// FindUserLike mocks base method
+func (m *MockLikeDatabase) FindUserLike(arg0 context.Context, arg1, arg2, arg3 string, arg4 int) ([]models.UserLike, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindUserLike", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].([]models.UserLike)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// FindUserLike indicates an expected call of FindUserLike
+func (mr *MockLikeDatabaseMockRecorder) FindUserLike(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindUserLike", reflect.TypeOf((*MockLikeDatabase)(nil).FindUserLike), arg0, arg1, arg2, arg3, arg4)
+}
+
+// ReconcileCount mocks base method
+func (m *MockLikeDatabase) ReconcileCount(arg0 context.Context, arg1 models.Target) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReconcileCount", arg0, arg1)
+	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// DeleteCommentLike indicates an expected call of DeleteCommentLike
-func (mr *MockLikeDatabaseMockRecorder) DeleteCommentLike(arg0, arg1 interface{}) *gomock.Call {
+// ReconcileCount indicates an expected call of ReconcileCount
+func (mr *MockLikeDatabaseMockRecorder) ReconcileCount(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteCommentLike", reflect.TypeOf((*MockLikeDatabase)(nil).DeleteCommentLike), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReconcileCount", reflect.TypeOf((*MockLikeDatabase)(nil).ReconcileCount), arg0, arg1)
 }
 
-// FindUserLike mocks base method
-func (m *MockLikeDatabase) FindUserLike(arg0 string) ([]string, error) {
+// DeleteUserLikes mocks base method
+func (m *MockLikeDatabase) DeleteUserLikes(arg0 context.Context, arg1 string) (int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindUserLike", arg0)
-	ret0, _ := ret[0].([]string)
+	ret := m.ctrl.Call(m, "DeleteUserLikes", arg0, arg1)
+	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// FindUserLike indicates an expected call of FindUserLike
-func (mr *MockLikeDatabaseMockRecorder) FindUserLike(arg0 interface{}) *gomock.Call {
+// DeleteUserLikes indicates an expected call of DeleteUserLikes
+func (mr *MockLikeDatabaseMockRecorder) DeleteUserLikes(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUserLikes", reflect.TypeOf((*MockLikeDatabase)(nil).DeleteUserLikes), arg0, arg1)
+}
+
+// DeleteTargetLikes mocks base method
+func (m *MockLikeDatabase) DeleteTargetLikes(arg0 context.Context, arg1 models.Target) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteTargetLikes", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteTargetLikes indicates an expected call of DeleteTargetLikes
+func (mr *MockLikeDatabaseMockRecorder) DeleteTargetLikes(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteTargetLikes", reflect.TypeOf((*MockLikeDatabase)(nil).DeleteTargetLikes), arg0, arg1)
+}
+
+// EnsureIndexes mocks base method
+func (m *MockLikeDatabase) EnsureIndexes(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnsureIndexes", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnsureIndexes indicates an expected call of EnsureIndexes
+func (mr *MockLikeDatabaseMockRecorder) EnsureIndexes(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureIndexes", reflect.TypeOf((*MockLikeDatabase)(nil).EnsureIndexes), arg0)
+}
+
+// MigrateLegacyLikes mocks base method
+func (m *MockLikeDatabase) MigrateLegacyLikes(arg0 context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MigrateLegacyLikes", arg0)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MigrateLegacyLikes indicates an expected call of MigrateLegacyLikes
+func (mr *MockLikeDatabaseMockRecorder) MigrateLegacyLikes(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MigrateLegacyLikes", reflect.TypeOf((*MockLikeDatabase)(nil).MigrateLegacyLikes), arg0)
+}
+
+// DedupeLikes mocks base method
+func (m *MockLikeDatabase) DedupeLikes(arg0 context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DedupeLikes", arg0)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DedupeLikes indicates an expected call of DedupeLikes
+func (mr *MockLikeDatabaseMockRecorder) DedupeLikes(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindUserLike", reflect.TypeOf((*MockLikeDatabase)(nil).FindUserLike), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DedupeLikes", reflect.TypeOf((*MockLikeDatabase)(nil).DedupeLikes), arg0)
 }
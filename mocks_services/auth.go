@@ -5,6 +5,7 @@
 package mocks_services
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 )
@@ -33,33 +34,33 @@ func (m *MockAuthService) EXPECT() *MockAuthServiceMockRecorder {
 }
 
 // Login mocks base method
-func (m *MockAuthService) Login(service, email, password string) (string, error) {
+func (m *MockAuthService) Login(ctx context.Context, service, email, password string) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Login", service, email, password)
+	ret := m.ctrl.Call(m, "Login", ctx, service, email, password)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Login indicates an expected call of Login
-func (mr *MockAuthServiceMockRecorder) Login(service, email, password interface{}) *gomock.Call {
+func (mr *MockAuthServiceMockRecorder) Login(ctx, service, email, password interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Login", reflect.TypeOf((*MockAuthService)(nil).Login), service, email, password)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Login", reflect.TypeOf((*MockAuthService)(nil).Login), ctx, service, email, password)
 }
 
 // Check mocks base method
-func (m *MockAuthService) Check(service, token string) (string, error) {
+func (m *MockAuthService) Check(ctx context.Context, service, token string) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Check", service, token)
+	ret := m.ctrl.Call(m, "Check", ctx, service, token)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Check indicates an expected call of Check
-func (mr *MockAuthServiceMockRecorder) Check(service, token interface{}) *gomock.Call {
+func (mr *MockAuthServiceMockRecorder) Check(ctx, service, token interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Check", reflect.TypeOf((*MockAuthService)(nil).Check), service, token)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Check", reflect.TypeOf((*MockAuthService)(nil).Check), ctx, service, token)
 }
 
 // Update mocks base method
@@ -78,18 +79,18 @@ func (mr *MockAuthServiceMockRecorder) Update() *gomock.Call {
 }
 
 // Create mocks base method
-func (m *MockAuthService) Create(service, email, password string) (bool, error) {
+func (m *MockAuthService) Create(ctx context.Context, service, email, password string) (bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Create", service, email, password)
+	ret := m.ctrl.Call(m, "Create", ctx, service, email, password)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Create indicates an expected call of Create
-func (mr *MockAuthServiceMockRecorder) Create(service, email, password interface{}) *gomock.Call {
+func (mr *MockAuthServiceMockRecorder) Create(ctx, service, email, password interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockAuthService)(nil).Create), service, email, password)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockAuthService)(nil).Create), ctx, service, email, password)
 }
 
 // Delete mocks base method
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/vinhut/like-service/helpers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type AuditDatabase interface {
+	Record(context.Context, AuditRecord) error
+}
+
+type auditDatabase struct {
+	db helpers.DatabaseHelper
+}
+
+// AuditRecord is written for every admin action, before it is carried out.
+// Actor is the admin, Uid the user and Targettype and Targetid the target
+// the action is about, when it is about one.
+type AuditRecord struct {
+	Auditid    primitive.ObjectID `bson:"_id, omitempty"`
+	Actor      string
+	Role       string
+	Action     string
+	Uid        string
+	Targettype string
+	Targetid   string
+	Created    time.Time
+}
+
+func NewAuditDatabase(db helpers.DatabaseHelper) AuditDatabase {
+	return &auditDatabase{
+		db: db,
+	}
+}
+
+func (auditdb *auditDatabase) Record(ctx context.Context, record AuditRecord) error {
+	if record.Auditid.IsZero() {
+		record.Auditid = primitive.NewObjectIDFromTimestamp(record.Created)
+	}
+	return auditdb.db.Insert(ctx, "audit", record)
+}
+
+type sqlAuditDatabase struct {
+	db *sql.DB
+}
+
+// NewSQLAuditDatabase keeps the audit trail in the audit table of db.
+func NewSQLAuditDatabase(db *sql.DB) AuditDatabase {
+	return &sqlAuditDatabase{
+		db: db,
+	}
+}
+
+func (auditdb *sqlAuditDatabase) Record(ctx context.Context, record AuditRecord) error {
+	if record.Auditid.IsZero() {
+		record.Auditid = primitive.NewObjectIDFromTimestamp(record.Created)
+	}
+	_, err := auditdb.db.ExecContext(ctx,
+		"insert into audit (id, actor, role, action, uid, targettype, targetid, created) values (?, ?, ?, ?, ?, ?, ?, ?)",
+		record.Auditid.Hex(), record.Actor, record.Role, record.Action, record.Uid, record.Targettype, record.Targetid, unixMillis(record.Created))
+	return helpers.SQLError(ctx, err)
+}
@@ -0,0 +1,234 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/vinhut/like-service/helpers"
+)
+
+var ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+type IdempotencyDatabase interface {
+	Reserve(context.Context, string, string, string) (IdempotencyRecord, bool, error)
+	Complete(context.Context, string, string, IdempotencyRecord) error
+	Release(context.Context, string, string, IdempotencyRecord) error
+	EnsureIndexes(context.Context) error
+}
+
+type idempotencyDatabase struct {
+	db    helpers.DatabaseHelper
+	ttl   time.Duration
+	lease time.Duration
+}
+
+// IdempotencyRecord remembers the request a user made with an idempotency
+// key, by its Fingerprint, and the response it got. Status is 0 while the
+// request is still being handled. Created tells the reservations of a key
+// apart, as a reservation left in progress is taken over once its lease is
+// up.
+type IdempotencyRecord struct {
+	Uid         string
+	Key         string
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+	Created     time.Time
+}
+
+// NewIdempotencyDatabase keeps the records of idempotency keys for ttl, and
+// lets a request that is still in progress after lease, likely one that
+// crashed, be retried.
+func NewIdempotencyDatabase(db helpers.DatabaseHelper, ttl time.Duration, lease time.Duration) IdempotencyDatabase {
+	return &idempotencyDatabase{
+		db:    db,
+		ttl:   ttl,
+		lease: lease,
+	}
+}
+
+// expired reports whether the record of a key no longer holds the key,
+// because it is older than ttl or its request is in progress for longer
+// than lease.
+func expired(record IdempotencyRecord, ttl time.Duration, lease time.Duration) bool {
+	age := time.Since(record.Created)
+	return age >= ttl || (record.Status == 0 && age >= lease)
+}
+
+func idempotencyQuery(userid string, key string) helpers.Filter {
+	return helpers.And(
+		helpers.Eq("uid", userid),
+		helpers.Eq("key", key),
+	)
+}
+
+// Reserve claims key for the request of userid with fingerprint. When the
+// key is already taken it returns false and the record of the request that
+// took it. An expired record is removed by its created time, so of the
+// retries taking over a key only one gets it.
+func (idemdb *idempotencyDatabase) Reserve(ctx context.Context, userid string, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+
+	record := IdempotencyRecord{
+		Uid:         userid,
+		Key:         key,
+		Fingerprint: fingerprint,
+		Created:     time.Now(),
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		insert_err := idemdb.db.Insert(ctx, "idempotency", record)
+		if insert_err == nil {
+			return record, true, nil
+		}
+		if !errors.Is(insert_err, helpers.ErrDuplicate) {
+			return IdempotencyRecord{}, false, insert_err
+		}
+
+		existing := IdempotencyRecord{}
+		query_err := idemdb.db.Query(ctx, "idempotency", idempotencyQuery(userid, key), &existing)
+		if errors.Is(query_err, helpers.ErrNotFound) {
+			continue
+		}
+		if query_err != nil {
+			return IdempotencyRecord{}, false, query_err
+		}
+		// the database removes expired records with a delay, and never
+		// the reservations left by crashed requests
+		if !expired(existing, idemdb.ttl, idemdb.lease) {
+			return existing, false, nil
+		}
+		if _, delete_err := idemdb.db.Delete(ctx, "idempotency", reservationQuery(existing)); delete_err != nil {
+			return IdempotencyRecord{}, false, delete_err
+		}
+	}
+	return IdempotencyRecord{}, false, helpers.ErrDuplicate
+}
+
+// reservationQuery matches record as long as no other request took its key
+// over.
+func reservationQuery(record IdempotencyRecord) helpers.Filter {
+	return helpers.And(idempotencyQuery(record.Uid, record.Key), helpers.Eq("created", record.Created))
+}
+
+// Complete stores the response to the request that reserved key with
+// record. It fails with helpers.ErrDuplicate when another request took the
+// key over.
+func (idemdb *idempotencyDatabase) Complete(ctx context.Context, userid string, key string, record IdempotencyRecord) error {
+	record.Uid = userid
+	record.Key = key
+	_, err := idemdb.db.Upsert(ctx, "idempotency", reservationQuery(record), record)
+	return err
+}
+
+// Release frees key, so a request that failed can be retried with it,
+// unless another request took the key over.
+func (idemdb *idempotencyDatabase) Release(ctx context.Context, userid string, key string, record IdempotencyRecord) error {
+	record.Uid = userid
+	record.Key = key
+	_, err := idemdb.db.Delete(ctx, "idempotency", reservationQuery(record))
+	return err
+}
+
+// EnsureIndexes creates the unique index that lets a key be reserved once
+// per user, and the index expiring records after the ttl.
+func (idemdb *idempotencyDatabase) EnsureIndexes(ctx context.Context) error {
+	if err := idemdb.db.EnsureIndex(ctx, "idempotency", []string{"uid", "key"}, true); err != nil {
+		return err
+	}
+	return idemdb.db.EnsureTTLIndex(ctx, "idempotency", "created", idemdb.ttl)
+}
+
+type sqlIdempotencyDatabase struct {
+	db    *sql.DB
+	ttl   time.Duration
+	lease time.Duration
+}
+
+// NewSQLIdempotencyDatabase keeps the records of idempotency keys in the
+// idempotency table of db for ttl, with a lease as NewIdempotencyDatabase.
+func NewSQLIdempotencyDatabase(db *sql.DB, ttl time.Duration, lease time.Duration) IdempotencyDatabase {
+	return &sqlIdempotencyDatabase{
+		db:    db,
+		ttl:   ttl,
+		lease: lease,
+	}
+}
+
+const idempotency_columns = "uid, key, fingerprint, status, content_type, body, created"
+
+// Reserve also removes the expired records, SQLite having no TTL index.
+func (idemdb *sqlIdempotencyDatabase) Reserve(ctx context.Context, userid string, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+
+	record := IdempotencyRecord{
+		Uid:         userid,
+		Key:         key,
+		Fingerprint: fingerprint,
+		Created:     time.Now(),
+	}
+	existing := IdempotencyRecord{}
+	reserved := false
+	err := transact(ctx, idemdb.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "delete from idempotency where created < ?", unixMillis(record.Created.Add(-idemdb.ttl)))
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx,
+			"insert into idempotency ("+idempotency_columns+") values (?, ?, ?, 0, '', null, ?) on conflict (uid, key) do nothing",
+			userid, key, fingerprint, unixMillis(record.Created))
+		if err != nil {
+			return err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil || inserted == 1 {
+			reserved = true
+			return err
+		}
+
+		created := int64(0)
+		err = tx.QueryRowContext(ctx,
+			"select "+idempotency_columns+" from idempotency where uid = ? and key = ?", userid, key).Scan(
+			&existing.Uid, &existing.Key, &existing.Fingerprint, &existing.Status, &existing.ContentType, &existing.Body, &created)
+		existing.Created = fromUnixMillis(created)
+		if err != nil || !expired(existing, idemdb.ttl, idemdb.lease) {
+			return err
+		}
+
+		// a reservation left in progress for longer than the lease
+		_, err = tx.ExecContext(ctx,
+			"update idempotency set fingerprint = ?, status = 0, content_type = '', body = null, created = ? where uid = ? and key = ?",
+			fingerprint, unixMillis(record.Created), userid, key)
+		reserved = err == nil
+		return err
+	})
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if reserved {
+		return record, true, nil
+	}
+	return existing, false, nil
+}
+
+func (idemdb *sqlIdempotencyDatabase) Complete(ctx context.Context, userid string, key string, record IdempotencyRecord) error {
+	_, err := idemdb.db.ExecContext(ctx,
+		`insert into idempotency (`+idempotency_columns+`) values (?, ?, ?, ?, ?, ?, ?)
+		on conflict (uid, key) do update set fingerprint = excluded.fingerprint, status = excluded.status,
+		content_type = excluded.content_type, body = excluded.body
+		where idempotency.created = excluded.created`,
+		userid, key, record.Fingerprint, record.Status, record.ContentType, record.Body, unixMillis(record.Created))
+	return helpers.SQLError(ctx, err)
+}
+
+func (idemdb *sqlIdempotencyDatabase) Release(ctx context.Context, userid string, key string, record IdempotencyRecord) error {
+	_, err := idemdb.db.ExecContext(ctx,
+		"delete from idempotency where uid = ? and key = ? and created = ?",
+		userid, key, unixMillis(record.Created))
+	return helpers.SQLError(ctx, err)
+}
+
+func (idemdb *sqlIdempotencyDatabase) EnsureIndexes(ctx context.Context) error {
+	_, err := MigrateSQL(ctx, idemdb.db)
+	return err
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinhut/like-service/helpers"
+)
+
+func TestIdempotencyLeaseTakeover(t *testing.T) {
+
+	backends := map[string]func(t *testing.T, lease time.Duration) IdempotencyDatabase{
+		"mongodb": func(t *testing.T, lease time.Duration) IdempotencyDatabase {
+			return NewIdempotencyDatabase(helpers.NewMemoryDatabase(), time.Hour, lease)
+		},
+		"sqlite": func(t *testing.T, lease time.Duration) IdempotencyDatabase {
+			return NewSQLIdempotencyDatabase(newTestSQLDatabase(t), time.Hour, lease)
+		},
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+
+			ctx := context.Background()
+			idemdb := open(t, time.Hour)
+			assert.NoError(t, idemdb.EnsureIndexes(ctx))
+			_, reserved, err := idemdb.Reserve(ctx, "u1", "k1", "f1")
+			assert.NoError(t, err)
+			assert.True(t, reserved)
+			_, reserved, err = idemdb.Reserve(ctx, "u1", "k1", "f1")
+			assert.NoError(t, err)
+			assert.False(t, reserved, "in progress within the lease")
+
+			idemdb = open(t, 0)
+			assert.NoError(t, idemdb.EnsureIndexes(ctx))
+			crashed, reserved, err := idemdb.Reserve(ctx, "u1", "k1", "f1")
+			assert.NoError(t, err)
+			assert.True(t, reserved)
+			// the created times of the reservations tell them apart
+			time.Sleep(2 * time.Millisecond)
+			retry, reserved, err := idemdb.Reserve(ctx, "u1", "k1", "f1")
+			assert.NoError(t, err)
+			assert.True(t, reserved, "taken over after the lease")
+
+			// the crashed request coming back leaves the retry alone
+			crashed.Status = 500
+			idemdb.Complete(ctx, "u1", "k1", crashed)
+			assert.NoError(t, idemdb.Release(ctx, "u1", "k1", crashed))
+
+			retry.Status = 200
+			retry.Body = []byte("Liked")
+			assert.NoError(t, idemdb.Complete(ctx, "u1", "k1", retry))
+			existing, reserved, err := idemdb.Reserve(ctx, "u1", "k1", "f1")
+			assert.NoError(t, err)
+			assert.False(t, reserved, "completed records outlive the lease")
+			assert.Equal(t, 200, existing.Status)
+			assert.Equal(t, []byte("Liked"), existing.Body)
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,33 +11,89 @@ import (
 )
 
 type LikeDatabase interface {
-	FindPost(string) (int, error)
-	PostIsLiked(string, string) (bool, error)
-	CreatePostLike(PostLike) (bool, error)
-	DeletePostLike(string, string) (bool, error)
-	FindComment(string) (int, error)
-	CommentIsLiked(string, string) (bool, error)
-	CreateCommentLike(CommentLike) (bool, error)
-	DeleteCommentLike(string, string) (bool, error)
-	FindUserLike(string) ([]string, error)
+	FindCount(context.Context, Target) (int, map[string]int, error)
+	CountSince(context.Context, Target, time.Time) (int, error)
+	CountByTarget(context.Context, string, []string) (map[string]int, error)
+	FindReaction(context.Context, Target, string) (string, error)
+	FindLike(context.Context, Target, string) (Like, bool, error)
+	CreateLike(context.Context, Like) (bool, error)
+	DeleteLike(context.Context, Target, string) (bool, error)
+	SetLike(context.Context, Like, bool, int) (int, error)
+	FindVersion(context.Context, Target, string) (int, error)
+	FindStates(context.Context, string, []string, string) ([]LikeState, error)
+	FindLikers(context.Context, Target, string, int) ([]Liker, string, error)
+	FindUserLike(context.Context, string, string, string, int) ([]UserLike, string, error)
+	ReconcileCount(context.Context, Target) (int, error)
+	DeleteUserLikes(context.Context, string) (int, error)
+	DeleteTargetLikes(context.Context, Target) (int, error)
+	EnsureIndexes(context.Context) error
+	MigrateLegacyLikes(context.Context) (int, error)
+	DedupeLikes(context.Context) (int, error)
 }
 
 type likeDatabase struct {
 	db helpers.DatabaseHelper
 }
 
-type PostLike struct {
-	Likeid  primitive.ObjectID `bson:"_id, omitempty"`
-	Uid     string
-	Postid  string
-	Created time.Time
+type Like struct {
+	Likeid     primitive.ObjectID `bson:"_id, omitempty"`
+	Uid        string
+	Targettype string
+	Targetid   string
+	Reaction   string
+	Created    time.Time
 }
 
-type CommentLike struct {
-	Likeid    primitive.ObjectID `bson:"_id, omitempty"`
-	Uid       string
-	Commentid string
-	Created   time.Time
+// Liker is one entry of a "who liked this" listing.
+type Liker struct {
+	Uid      string    `json:"uid"`
+	Reaction string    `json:"reaction"`
+	Created  time.Time `json:"created"`
+}
+
+// UserLike is one entry of the listing of what a user liked.
+type UserLike struct {
+	Likeid   primitive.ObjectID `json:"-"`
+	Type     string             `json:"type"`
+	Targetid string             `json:"id"`
+	Reaction string             `json:"reaction"`
+	Created  time.Time          `json:"created"`
+}
+
+// LikeState is what a feed needs to render the like button of a target.
+type LikeState struct {
+	Targetid string `json:"id"`
+	Count    int    `json:"count"`
+	Liked    bool   `json:"liked"`
+	Reaction string `json:"reaction,omitempty"`
+}
+
+var (
+	ErrInvalidCursor     = errors.New("invalid cursor")
+	ErrInvalidLimit      = errors.New("invalid limit")
+	ErrInvalidTargetType = errors.New("invalid target type")
+	ErrInvalidReaction   = errors.New("invalid reaction")
+	ErrVersionConflict   = errors.New("version conflict")
+)
+
+// LikeVersion counts the changes a user made with SetLike to their like of
+// a target, so a change can be made conditional on no other change having
+// come first.
+type LikeVersion struct {
+	Uid        string
+	Targettype string
+	Targetid   string
+	Version    int
+}
+
+// LikeCount is the denormalized counter kept next to the like records of a
+// target, so reading a count never scans the likes. Count is the total and
+// Reactions the count per reaction.
+type LikeCount struct {
+	Targettype string
+	Targetid   string
+	Count      int
+	Reactions  map[string]int
 }
 
 func NewLikeDatabase(db helpers.DatabaseHelper) LikeDatabase {
@@ -44,135 +102,631 @@ func NewLikeDatabase(db helpers.DatabaseHelper) LikeDatabase {
 	}
 }
 
-func (likedb *likeDatabase) FindPost(postid string) (int, error) {
+func targetQuery(target Target) helpers.Filter {
+	return helpers.And(
+		helpers.Eq("targettype", target.Type),
+		helpers.Eq("targetid", target.Id),
+	)
+}
+
+func likeQuery(target Target, userid string) helpers.Filter {
+	return helpers.And(
+		helpers.Eq("targettype", target.Type),
+		helpers.Eq("targetid", target.Id),
+		helpers.Eq("uid", userid),
+	)
+}
+
+// FindCount returns the like count of a target and its count per reaction.
+func (likedb *likeDatabase) FindCount(ctx context.Context, target Target) (int, map[string]int, error) {
 
-	result, err := likedb.db.QueryAll("postlike", "postid", postid, PostLike{})
+	if !ValidTargetType(target.Type) {
+		return 0, nil, ErrInvalidTargetType
+	}
+	counter := LikeCount{}
+	err := likedb.db.Query(ctx, "likecount", targetQuery(target), &counter)
+	if errors.Is(err, helpers.ErrNotFound) {
+		return 0, map[string]int{}, nil
+	}
 	if err != nil {
 		fmt.Println("model find error ", err)
+		return 0, nil, err
+	}
+
+	return counter.Count, nonZero(counter.Reactions), nil
+}
+
+// CountSince counts the likes of a target made, or changed to another
+// reaction, at or after since. Unlike FindCount it counts the likes
+// themselves rather than reading the counter.
+func (likedb *likeDatabase) CountSince(ctx context.Context, target Target, since time.Time) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
+	}
+	count, err := likedb.db.Count(ctx, "like", helpers.And(targetQuery(target), helpers.Gte("created", since)))
+	if err != nil {
+		fmt.Println("model count error ", err)
 		return 0, err
 	}
+	return count, nil
+}
 
-	result_count := len(result)
-	return result_count, nil
+// targetCount is a group of likes of an aggregation by target.
+type targetCount struct {
+	Targetid string
+	Count    int
 }
 
-func (likedb *likeDatabase) PostIsLiked(postid string, userid string) (bool, error) {
-	query := map[string]string{
-		"postid": postid,
-		"uid":    userid,
+// CountByTarget counts the likes of each target of a type, in one
+// aggregation regardless of how many targets are asked for. Like CountSince
+// it counts the likes themselves; every target asked for is in the result,
+// with a zero count when nobody liked it.
+func (likedb *likeDatabase) CountByTarget(ctx context.Context, targettype string, targetids []string) (map[string]int, error) {
+
+	if !ValidTargetType(targettype) {
+		return nil, ErrInvalidTargetType
+	}
+	counts := make(map[string]int, len(targetids))
+	for _, targetid := range targetids {
+		counts[targetid] = 0
+	}
+	aggregation := helpers.Aggregation{
+		Match:   helpers.And(helpers.Eq("targettype", targettype), helpers.InStrings("targetid", targetids)),
+		GroupBy: []string{"targetid"},
+	}
+	err := likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+		return likedb.db.Aggregate(ctx, "like", aggregation)
+	}, func(cursor helpers.Cursor) error {
+		group := targetCount{}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+		counts[group.Targetid] = group.Count
+		return nil
+	})
+	if err != nil {
+		fmt.Println("model count error ", err)
+		return nil, err
+	}
+	return counts, nil
+}
+
+// FindReaction returns the reaction userid left on a target, or an empty
+// reaction when userid did not like it.
+func (likedb *likeDatabase) FindReaction(ctx context.Context, target Target, userid string) (string, error) {
+
+	likedata, liked, query_err := likedb.FindLike(ctx, target, userid)
+	if query_err != nil || !liked {
+		return "", query_err
+	}
+	return likedata.Reaction, nil
+
+}
+
+// FindLike returns the like userid left on a target, and false when userid
+// did not like it.
+func (likedb *likeDatabase) FindLike(ctx context.Context, target Target, userid string) (Like, bool, error) {
+
+	if !ValidTargetType(target.Type) {
+		return Like{}, false, ErrInvalidTargetType
+	}
+	likedata := Like{}
+	query_err := likedb.db.Query(ctx, "like", likeQuery(target, userid), &likedata)
+	if errors.Is(query_err, helpers.ErrNotFound) {
+		return Like{}, false, nil
 	}
-	postdata := PostLike{}
-	query_err := likedb.db.Query("postlike", query, &postdata)
 	if query_err != nil {
-		return false, query_err
+		return Like{}, false, query_err
 	}
-	return true, nil
+	likedata.Reaction = reactionOf(likedata.Reaction)
+	return likedata, true, nil
 
 }
 
-func (likedb *likeDatabase) CreatePostLike(post PostLike) (bool, error) {
+// CreateLike records the reaction of a user on a target, replacing the
+// reaction the user left before if any.
+func (likedb *likeDatabase) CreateLike(ctx context.Context, like Like) (bool, error) {
 
-	query := map[string]string{
-		"postid": post.Postid,
-		"userid": post.Uid,
+	if err := validLike(like); err != nil {
+		return false, err
 	}
-	err := likedb.db.Upsert("postlike", query, post)
+	like.Reaction = reactionOf(like.Reaction)
+	changed, err := likedb.writeLike(ctx, like)
 	if err != nil {
 		return false, err
 	}
+	if changed {
+		target := Target{Type: like.Targettype, Id: like.Targetid}
+		if err := likedb.bumpVersion(ctx, target, like.Uid); err != nil {
+			return false, err
+		}
+	}
 	return true, nil
 }
 
-func (likedb *likeDatabase) DeletePostLike(postid string, userid string) (bool, error) {
+// writeLike stores a valid like and keeps the counter of its target in
+// step, reporting whether the reaction of the user changed. Repeating the
+// reaction the user left keeps the like as it is, created time included.
+func (likedb *likeDatabase) writeLike(ctx context.Context, like Like) (bool, error) {
+
+	target := Target{Type: like.Targettype, Id: like.Targetid}
+	previous := Like{}
+	query_err := likedb.db.Query(ctx, "like", likeQuery(target, like.Uid), &previous)
+	if query_err == nil && reactionOf(previous.Reaction) == like.Reaction {
+		return false, nil
+	}
+	if query_err != nil && !errors.Is(query_err, helpers.ErrNotFound) {
+		return false, query_err
+	}
+	previous = Like{}
+	existed, err := likedb.db.FindAndUpsert(ctx, "like", likeQuery(target, like.Uid), like, &previous)
+	if err != nil {
+		return false, err
+	}
+
+	previous_reaction := ""
+	if existed {
+		previous_reaction = reactionOf(previous.Reaction)
+	}
+	deltas := counterDeltas(previous_reaction, like.Reaction)
+	if len(deltas) != 0 {
+		if inc_err := likedb.moveCounter(ctx, target, deltas); inc_err != nil {
+			return false, inc_err
+		}
+	}
+	return len(deltas) != 0, nil
+}
 
-	query := map[string]string{
-		"postid": postid,
-		"userid": userid,
+// moveCounter adds deltas to the counter of target. Only a new like creates
+// the counter; the other changes move an existing counter with likes left,
+// so a counter missing or already at 0 never goes negative.
+func (likedb *likeDatabase) moveCounter(ctx context.Context, target Target, deltas map[string]int) error {
+	if deltas["count"] > 0 {
+		return likedb.db.Increment(ctx, "likecount", targetQuery(target), deltas)
 	}
+	query := helpers.And(targetQuery(target), helpers.Gt("count", 0))
+	_, err := likedb.db.IncrementAll(ctx, "likecount", query, deltas)
+	return err
+}
 
-	err := likedb.db.Delete("postlike", query)
+// bumpVersion counts a change of the like of userid on a target, so a
+// SetLike expecting the version from before the change conflicts.
+func (likedb *likeDatabase) bumpVersion(ctx context.Context, target Target, userid string) error {
+	return likedb.db.Increment(ctx, "likeversion", likeQuery(target, userid), map[string]int{"version": 1})
+}
+
+// validLike checks the target, uid and reaction of like before it is stored,
+// an empty reaction being the default one.
+func validLike(like Like) error {
+	if !ValidTargetType(like.Targettype) {
+		return ErrInvalidTargetType
+	}
+	if err := ValidTargetId(like.Targettype, like.Targetid); err != nil {
+		return err
+	}
+	if err := ValidUid(like.Uid); err != nil {
+		return err
+	}
+	if like.Reaction != "" && !ValidReaction(like.Reaction) {
+		return ErrInvalidReaction
+	}
+	return nil
+}
+
+func (likedb *likeDatabase) DeleteLike(ctx context.Context, target Target, userid string) (bool, error) {
+
+	if !ValidTargetType(target.Type) {
+		return false, ErrInvalidTargetType
+	}
+	changed, err := likedb.removeLike(ctx, target, userid)
 	if err != nil {
 		return false, err
 	}
+	if changed {
+		if err := likedb.bumpVersion(ctx, target, userid); err != nil {
+			return false, err
+		}
+	}
 	return true, nil
 }
 
-func (likedb *likeDatabase) FindComment(commentid string) (int, error) {
+// removeLike deletes the like of userid on a target and keeps the counter
+// of the target in step, reporting whether there was a like.
+func (likedb *likeDatabase) removeLike(ctx context.Context, target Target, userid string) (bool, error) {
 
-	result, err := likedb.db.QueryAll("commentlike", "commentid", commentid, CommentLike{})
+	deleted := Like{}
+	existed, err := likedb.db.FindAndDelete(ctx, "like", likeQuery(target, userid), &deleted)
+	if err != nil || !existed {
+		return false, err
+	}
+	deltas := counterDeltas(reactionOf(deleted.Reaction), "")
+	if inc_err := likedb.moveCounter(ctx, target, deltas); inc_err != nil {
+		return false, inc_err
+	}
+	return true, nil
+}
+
+// FindVersion returns the version of the like of userid on a target, 0 for
+// a like never changed.
+func (likedb *likeDatabase) FindVersion(ctx context.Context, target Target, userid string) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
+	}
+	current := LikeVersion{}
+	err := likedb.db.Query(ctx, "likeversion", likeQuery(target, userid), &current)
+	if err != nil && !errors.Is(err, helpers.ErrNotFound) {
+		return 0, err
+	}
+	return current.Version, nil
+}
+
+// SetLike likes or unlikes a target for like.Uid, with like.Reaction when
+// liking, and returns the version of the like after the change. With an
+// expected version of 0 or more the change is only made if the like is at
+// that version, a like never set being at 0; otherwise it fails with
+// ErrVersionConflict and the version the like is at. Every other change to
+// the like moves its version on too.
+//
+// The version is taken before the like is written, so that no other change
+// comes in between, and given back if the write fails.
+func (likedb *likeDatabase) SetLike(ctx context.Context, like Like, liked bool, expected int) (int, error) {
+
+	if liked {
+		if err := validLike(like); err != nil {
+			return 0, err
+		}
+	} else if !ValidTargetType(like.Targettype) {
+		return 0, ErrInvalidTargetType
+	}
+	like.Reaction = reactionOf(like.Reaction)
+	target := Target{Type: like.Targettype, Id: like.Targetid}
+	query := likeQuery(target, like.Uid)
+	version, err := likedb.db.CompareAndIncrement(ctx, "likeversion", query, "version", expected)
+	if errors.Is(err, helpers.ErrConflict) {
+		current, find_err := likedb.FindVersion(ctx, target, like.Uid)
+		if find_err != nil {
+			return 0, find_err
+		}
+		return current, ErrVersionConflict
+	}
 	if err != nil {
-		fmt.Println("model find error ", err)
 		return 0, err
 	}
 
-	result_count := len(result)
-	return result_count, nil
+	if liked {
+		_, err = likedb.writeLike(ctx, like)
+	} else {
+		_, err = likedb.removeLike(ctx, target, like.Uid)
+	}
+	if err != nil {
+		likedb.releaseVersion(ctx, target, like.Uid, version)
+		return 0, err
+	}
+	return version, nil
 }
 
-func (likedb *likeDatabase) CommentIsLiked(commentid string, userid string) (bool, error) {
-	query := map[string]string{
-		"commentid": commentid,
-		"uid":       userid,
+// releaseVersion gives back a version SetLike took for a change it failed
+// to write, unless another change moved the like on since. The version
+// document matches a unique index, so when it moved on the decrement fails
+// to insert a second one instead.
+func (likedb *likeDatabase) releaseVersion(ctx context.Context, target Target, userid string, version int) {
+	query := helpers.And(likeQuery(target, userid), helpers.Eq("version", version))
+	err := likedb.db.Increment(ctx, "likeversion", query, map[string]int{"version": -1})
+	if err != nil && !errors.Is(err, helpers.ErrDuplicate) {
+		fmt.Println("model release version error ", err)
 	}
+}
 
-	commentdata := CommentLike{}
-	query_err := likedb.db.Query("commentlike", query, &commentdata)
-	if query_err != nil {
-		return false, query_err
+// FindStates returns the like count of each target of a type and the
+// reaction userid left on it, in the order of targetids, using one query for
+// the counters and one for the user's likes regardless of how many targets
+// are asked for. An empty userid, an anonymous caller, liked nothing.
+func (likedb *likeDatabase) FindStates(ctx context.Context, targettype string, targetids []string, userid string) ([]LikeState, error) {
+
+	if !ValidTargetType(targettype) {
+		return nil, ErrInvalidTargetType
+	}
+	batch := helpers.InStrings("targetid", targetids)
+	query := helpers.And(helpers.Eq("targettype", targettype), batch)
+	counts := make(map[string]int, len(targetids))
+	opts := helpers.FindOptions{Projection: []string{"targetid", "count"}}
+	err := likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+		return likedb.db.Find(ctx, "likecount", query, opts)
+	}, func(cursor helpers.Cursor) error {
+		counter := LikeCount{}
+		if err := cursor.Decode(&counter); err != nil {
+			return err
+		}
+		counts[counter.Targetid] = counter.Count
+		return nil
+	})
+	if err != nil {
+		fmt.Println("model find error ", err)
+		return nil, err
+	}
+	reactions := make(map[string]string, len(targetids))
+	if userid != "" {
+		query = helpers.And(helpers.Eq("targettype", targettype), helpers.Eq("uid", userid), batch)
+		opts = helpers.FindOptions{Projection: []string{"targetid", "reaction"}}
+		err = likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+			return likedb.db.Find(ctx, "like", query, opts)
+		}, func(cursor helpers.Cursor) error {
+			like := Like{}
+			if err := cursor.Decode(&like); err != nil {
+				return err
+			}
+			reactions[like.Targetid] = reactionOf(like.Reaction)
+			return nil
+		})
+		if err != nil {
+			fmt.Println("model find error ", err)
+			return nil, err
+		}
 	}
-	return true, nil
 
+	states := make([]LikeState, len(targetids))
+	for i, targetid := range targetids {
+		states[i] = LikeState{
+			Targetid: targetid,
+			Count:    counts[targetid],
+			Liked:    reactions[targetid] != "",
+			Reaction: reactions[targetid],
+		}
+	}
+	return states, nil
 }
 
-func (likedb *likeDatabase) CreateCommentLike(comment CommentLike) (bool, error) {
+// FindLikers lists who liked a target, newest first, limit at a time.
+// cursor is empty for the first page and otherwise the next cursor returned
+// by the previous call; an empty next cursor means there are no more pages.
+// A limit under 1 is ErrInvalidLimit.
+func (likedb *likeDatabase) FindLikers(ctx context.Context, target Target, cursor string, limit int) ([]Liker, string, error) {
 
-	query := map[string]string{
-		"postid": comment.Commentid,
-		"userid": comment.Uid,
+	if !ValidTargetType(target.Type) {
+		return nil, "", ErrInvalidTargetType
 	}
-	err := likedb.db.Upsert("commentlike", query, comment)
+	before, err := parseCursor(cursor)
 	if err != nil {
-		return false, err
+		return nil, "", err
 	}
-	return true, nil
+	likes, next, err := likedb.findPage(ctx, targetQuery(target), before, limit)
+	if err != nil {
+		fmt.Println("model find error ", err)
+		return nil, "", err
+	}
+
+	likers := make([]Liker, 0, len(likes))
+	for _, like := range likes {
+		likers = append(likers, Liker{Uid: like.Uid, Reaction: reactionOf(like.Reaction), Created: like.Created})
+	}
+	return likers, next, nil
 }
 
-func (likedb *likeDatabase) DeleteCommentLike(commentid string, userid string) (bool, error) {
+// FindUserLike lists what userid liked, newest first, limit at a time.
+// targettype restricts the listing to one type of target when not empty.
+// Paging works like FindLikers.
+func (likedb *likeDatabase) FindUserLike(ctx context.Context, userid string, targettype string, cursor string, limit int) ([]UserLike, string, error) {
 
-	query := map[string]string{
-		"commentid": commentid,
-		"userid":    userid,
+	if targettype != "" && !ValidTargetType(targettype) {
+		return nil, "", ErrInvalidTargetType
+	}
+	before, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	query := helpers.Eq("uid", userid)
+	if targettype != "" {
+		query = helpers.And(query, helpers.Eq("targettype", targettype))
+	}
+	result, next, err := likedb.findPage(ctx, query, before, limit)
+	if err != nil {
+		fmt.Println("model find error ", err)
+		return nil, "", err
 	}
 
-	err := likedb.db.Delete("commentlike", query)
+	likes := make([]UserLike, 0, len(result))
+	for _, like := range result {
+		likes = append(likes, UserLike{
+			Likeid:   like.Likeid,
+			Type:     like.Targettype,
+			Targetid: like.Targetid,
+			Reaction: reactionOf(like.Reaction),
+			Created:  like.Created,
+		})
+	}
+	return likes, next, nil
+}
+
+// findPage returns the likes matching query, newest first, limit at a time
+// before the like with the id before, and the cursor of the next page.
+func (likedb *likeDatabase) findPage(ctx context.Context, query helpers.Filter, before primitive.ObjectID, limit int) ([]Like, string, error) {
+
+	if limit < 1 {
+		return nil, "", ErrInvalidLimit
+	}
+	if !before.IsZero() {
+		query = helpers.And(query, helpers.Lt("_id", before))
+	}
+	opts := helpers.FindOptions{
+		Sort: []helpers.SortField{helpers.Desc("_id")},
+		// one more than a page, to know whether there is a next one
+		Limit: limit + 1,
+	}
+	likes := make([]Like, 0, limit+1)
+	err := likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+		return likedb.db.Find(ctx, "like", query, opts)
+	}, func(cursor helpers.Cursor) error {
+		like := Like{}
+		if err := cursor.Decode(&like); err != nil {
+			return err
+		}
+		likes = append(likes, like)
+		return nil
+	})
 	if err != nil {
-		return false, err
+		return nil, "", err
 	}
-	return true, nil
+
+	next := ""
+	if len(likes) > limit {
+		likes = likes[:limit]
+		next = likes[limit-1].Likeid.Hex()
+	}
+	return likes, next, nil
 }
 
-func (likedb *likeDatabase) FindUserLike(userid string) ([]string, error) {
+// eachDoc runs the query find starts and calls fn on every document it
+// returns, stopping at the first error.
+func (likedb *likeDatabase) eachDoc(ctx context.Context, find func() (helpers.Cursor, error), fn func(helpers.Cursor) error) error {
 
-	var result_str []string
-	result, err := likedb.db.QueryAll("postlike", "userid", userid, PostLike{})
+	cursor, err := find()
 	if err != nil {
-		fmt.Println("model find error ", err)
-		return nil, err
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		if err := fn(cursor); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ReconcileCount recounts the likes of a target and overwrites its counter,
+// repairing any drift between the records and the counter.
+func (likedb *likeDatabase) ReconcileCount(ctx context.Context, target Target) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
+	}
+	return likedb.recount(ctx, target)
+}
+
+// recount overwrites the counter of target with the count of its likes.
+func (likedb *likeDatabase) recount(ctx context.Context, target Target) (int, error) {
+
+	query := targetQuery(target)
+	count, reactions, err := likedb.countReactions(ctx, "like", query)
+	if err != nil {
+		fmt.Println("model count error ", err)
+		return 0, err
+	}
+
+	counter := LikeCount{
+		Targettype: target.Type,
+		Targetid:   target.Id,
+		Count:      count,
+		Reactions:  reactions,
+	}
+	_, upsert_err := likedb.db.Upsert(ctx, "likecount", query, counter)
+	if upsert_err != nil {
+		return 0, upsert_err
+	}
+	return count, nil
+}
+
+// DeleteUserLikes removes every like of userid, keeping the counters of the
+// targets in step, and returns how many it removed.
+func (likedb *likeDatabase) DeleteUserLikes(ctx context.Context, userid string) (int, error) {
+	return likedb.deleteLikes(ctx, helpers.Eq("uid", userid))
+}
+
+// DeleteTargetLikes removes every like of a target, keeping its counter in
+// step, and returns how many it removed.
+func (likedb *likeDatabase) DeleteTargetLikes(ctx context.Context, target Target) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
 	}
+	return likedb.deleteLikes(ctx, targetQuery(target))
+}
 
-	results := make([]PostLike, len(result))
+// deleteLikes removes the likes matching query in bulk and returns how many
+// it removed. The counters of the targets the likes were on are recounted
+// once each, and the versions of the likes of query on those targets moved
+// on in one update, so even those of likes deleted before move on.
+func (likedb *likeDatabase) deleteLikes(ctx context.Context, query helpers.Filter) (int, error) {
+
+	targets := []Target{}
+	targetids := map[string][]string{}
+	aggregation := helpers.Aggregation{Match: query, GroupBy: []string{"targettype", "targetid"}}
+	err := likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+		return likedb.db.Aggregate(ctx, "like", aggregation)
+	}, func(cursor helpers.Cursor) error {
+		like := Like{}
+		if err := cursor.Decode(&like); err != nil {
+			return err
+		}
+		targets = append(targets, Target{Type: like.Targettype, Id: like.Targetid})
+		targetids[like.Targettype] = append(targetids[like.Targettype], like.Targetid)
+		return nil
+	})
+	if err != nil || len(targets) == 0 {
+		return 0, err
+	}
 
-	for i, d := range result {
-		if d == nil {
-			fmt.Println("d is nil")
+	// only the targets recounted below, leaving the likes made meanwhile on
+	// other targets
+	scope := []helpers.Filter{}
+	for targettype, ids := range targetids {
+		scope = append(scope, helpers.And(helpers.Eq("targettype", targettype), helpers.InStrings("targetid", ids)))
+	}
+	query = helpers.And(query, helpers.Or(scope...))
+	deleted, err := likedb.db.DeleteAll(ctx, "like", query)
+	if err != nil {
+		fmt.Println("model delete error ", err)
+		return 0, err
+	}
+	if _, err := likedb.db.IncrementAll(ctx, "likeversion", query, map[string]int{"version": 1}); err != nil {
+		return deleted, err
+	}
+	for _, target := range targets {
+		if _, err := likedb.recount(ctx, target); err != nil {
+			fmt.Println("model count error ", err)
+			return deleted, err
 		}
-		fmt.Println("d = ", d)
-		results[i] = d.(PostLike)
 	}
+	return deleted, nil
+}
+
+func parseCursor(cursor string) (primitive.ObjectID, error) {
+	if cursor == "" {
+		return primitive.NilObjectID, nil
+	}
+	before, err := primitive.ObjectIDFromHex(cursor)
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidCursor
+	}
+	return before, nil
+}
 
-	for _, postlike := range results {
-		result_str = append(result_str, postlike.Uid)
+// EnsureIndexes creates the unique indexes that make likes idempotent per
+// (uid, target), keep a single counter document per target and a single
+// version document per like, plus the indexes backing the likers and user
+// like listings and the counts of recent likes.
+func (likedb *likeDatabase) EnsureIndexes(ctx context.Context) error {
+
+	indexes := []struct {
+		collection string
+		keys       []string
+		unique     bool
+	}{
+		{"like", []string{"uid", "targettype", "targetid"}, true},
+		{"likecount", []string{"targettype", "targetid"}, true},
+		{"like", []string{"targettype", "targetid", "_id"}, false},
+		{"like", []string{"uid", "_id"}, false},
+		{"like", []string{"uid", "targettype", "_id"}, false},
+		{"like", []string{"targettype", "targetid", "created"}, false},
+		{"likeversion", []string{"uid", "targettype", "targetid"}, true},
 	}
 
-	return result_str, nil
+	for _, index := range indexes {
+		err := likedb.db.EnsureIndex(ctx, index.collection, index.keys, index.unique)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,521 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinhut/like-service/helpers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// like_database_conformance is the behaviour every LikeDatabase shares,
+// whatever stores the likes. Each case gets an empty database.
+var like_database_conformance = []struct {
+	name string
+	test func(*testing.T, LikeDatabase)
+}{
+	{"CreateLikeIsIdempotent", testCreateLikeIsIdempotent},
+	{"RepeatKeepsCreated", testRepeatKeepsCreated},
+	{"UnknownReactionCountsAsDefault", testUnknownReactionCountsAsDefault},
+	{"DeleteUnknownReactionAfterReconcile", testDeleteUnknownReactionAfterReconcile},
+	{"DeleteWithoutCounter", testDeleteWithoutCounter},
+	{"DeleteLike", testDeleteLike},
+	{"ChangesOnlyOwnLike", testChangesOnlyOwnLike},
+	{"FindLike", testFindLike},
+	{"InvalidLike", testInvalidLike},
+	{"FindStates", testFindStates},
+	{"CountSince", testCountSince},
+	{"CountByTarget", testCountByTarget},
+	{"FindLikersPages", testFindLikersPages},
+	{"SetLikeVersion", testSetLikeVersion},
+	{"EveryChangeMovesVersion", testEveryChangeMovesVersion},
+	{"DeleteUserAndTargetLikes", testDeleteUserAndTargetLikes},
+}
+
+func runConformance(t *testing.T, newdb func(*testing.T) LikeDatabase) {
+	for _, c := range like_database_conformance {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, newdb(t))
+		})
+	}
+}
+
+// TestLikeDatabase runs the MongoDB storage on the in-memory helper, which
+// matches documents the way MongoDB does.
+func TestLikeDatabase(t *testing.T) {
+	runConformance(t, func(t *testing.T) LikeDatabase {
+		likedb := NewLikeDatabase(helpers.NewMemoryDatabase())
+		assert.NoError(t, likedb.EnsureIndexes(context.Background()))
+		return likedb
+	})
+}
+
+func newLike(uid string, targetid string, reaction string) Like {
+	return Like{
+		Likeid:     primitive.NewObjectID(),
+		Uid:        uid,
+		Targettype: "post",
+		Targetid:   targetid,
+		Reaction:   reaction,
+		Created:    time.Now(),
+	}
+}
+
+func testRepeatKeepsCreated(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+	first := newLike("u1", "p1", "love")
+	first.Created = time.Now().Add(-time.Hour)
+	_, err := likedb.CreateLike(ctx, first)
+	assert.NoError(t, err)
+
+	// a retried like lands later with the same reaction
+	_, err = likedb.CreateLike(ctx, newLike("u1", "p1", "love"))
+	assert.NoError(t, err)
+	found, _, err := likedb.FindLike(ctx, target, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, first.Created.Unix(), found.Created.Unix())
+	assert.Equal(t, first.Likeid, found.Likeid)
+
+	_, err = likedb.CreateLike(ctx, newLike("u1", "p1", "sad"))
+	assert.NoError(t, err)
+	found, _, err = likedb.FindLike(ctx, target, "u1")
+	assert.NoError(t, err)
+	assert.True(t, found.Created.After(first.Created), "a new reaction is a new like")
+}
+
+// storeRawLike stores like as it is, past the validation of CreateLike, as
+// an older release could have.
+func storeRawLike(t *testing.T, likedb LikeDatabase, like Like) {
+	ctx := context.Background()
+	switch db := likedb.(type) {
+	case *likeDatabase:
+		assert.NoError(t, db.db.Insert(ctx, "like", like))
+	case *sqlLikeDatabase:
+		_, err := db.db.ExecContext(ctx, "insert into likes ("+like_columns+") values (?, ?, ?, ?, ?, ?)",
+			like.Likeid.Hex(), like.Uid, like.Targettype, like.Targetid, like.Reaction, unixMillis(like.Created))
+		assert.NoError(t, err)
+	default:
+		t.Fatalf("no raw store for %T", likedb)
+	}
+}
+
+func testUnknownReactionCountsAsDefault(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+	_, err := likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	assert.NoError(t, err)
+	storeRawLike(t, likedb, newLike("u2", "p1", "wow"))
+	_, err = likedb.ReconcileCount(ctx, target)
+	assert.NoError(t, err)
+
+	count, reactions, err := likedb.FindCount(ctx, target)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, map[string]int{"like": 2}, reactions)
+
+	// every read reports the reaction the like counts as
+	found, _, err := likedb.FindLike(ctx, target, "u2")
+	assert.NoError(t, err)
+	assert.Equal(t, "like", found.Reaction)
+	states, err := likedb.FindStates(ctx, "post", []string{"p1"}, "u2")
+	assert.NoError(t, err)
+	assert.Equal(t, "like", states[0].Reaction)
+	likers, _, err := likedb.FindLikers(ctx, target, "", 10)
+	assert.NoError(t, err)
+	for _, liker := range likers {
+		assert.Equal(t, "like", liker.Reaction)
+	}
+	likes, _, err := likedb.FindUserLike(ctx, "u2", "", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "like", likes[0].Reaction)
+}
+
+func testDeleteUnknownReactionAfterReconcile(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+	_, err := likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	assert.NoError(t, err)
+	storeRawLike(t, likedb, newLike("u2", "p1", "wow"))
+	_, err = likedb.ReconcileCount(ctx, target)
+	assert.NoError(t, err)
+
+	_, err = likedb.DeleteLike(ctx, target, "u2")
+	assert.NoError(t, err)
+	count, reactions, err := likedb.FindCount(ctx, target)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, map[string]int{"like": 1}, reactions)
+}
+
+func testDeleteWithoutCounter(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+	// a like stored without its counter, which is never made negative
+	storeRawLike(t, likedb, newLike("u1", "p1", "love"))
+	_, err := likedb.DeleteLike(ctx, target, "u1")
+	assert.NoError(t, err)
+
+	count, reactions, err := likedb.FindCount(ctx, target)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, map[string]int{}, reactions)
+}
+
+func testCreateLikeIsIdempotent(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+
+	for i := 0; i < 3; i++ {
+		_, err := likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+		assert.NoError(t, err)
+	}
+	_, err := likedb.CreateLike(ctx, newLike("u2", "p1", "love"))
+	assert.NoError(t, err)
+
+	count, reactions, err := likedb.FindCount(ctx, target)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, map[string]int{"like": 1, "love": 1}, reactions)
+
+	// changing the reaction moves the like between reactions
+	_, err = likedb.CreateLike(ctx, newLike("u1", "p1", "sad"))
+	assert.NoError(t, err)
+	count, reactions, _ = likedb.FindCount(ctx, target)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, map[string]int{"love": 1, "sad": 1}, reactions)
+
+	reaction, err := likedb.FindReaction(ctx, target, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, "sad", reaction)
+
+	reconciled, err := likedb.ReconcileCount(ctx, target)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, reconciled)
+}
+
+func testDeleteLike(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+
+	_, err := likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = likedb.DeleteLike(ctx, target, "u1")
+		assert.NoError(t, err)
+	}
+
+	count, _, _ := likedb.FindCount(ctx, target)
+	assert.Equal(t, 0, count)
+	reaction, _ := likedb.FindReaction(ctx, target, "u1")
+	assert.Equal(t, "", reaction)
+}
+
+func testChangesOnlyOwnLike(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	p1 := Target{Type: "post", Id: "p1"}
+	likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	likedb.CreateLike(ctx, newLike("u2", "p1", "sad"))
+	likedb.CreateLike(ctx, newLike("u1", "p2", ""))
+
+	// a like is matched by its user and its target, never by one of them
+	likedb.CreateLike(ctx, newLike("u1", "p1", "love"))
+	reaction, _ := likedb.FindReaction(ctx, p1, "u2")
+	assert.Equal(t, "sad", reaction)
+	reaction, _ = likedb.FindReaction(ctx, Target{Type: "post", Id: "p2"}, "u1")
+	assert.Equal(t, "like", reaction)
+
+	likedb.DeleteLike(ctx, p1, "u1")
+	reaction, _ = likedb.FindReaction(ctx, p1, "u2")
+	assert.Equal(t, "sad", reaction)
+	reaction, _ = likedb.FindReaction(ctx, Target{Type: "post", Id: "p2"}, "u1")
+	assert.Equal(t, "like", reaction)
+	count, _, _ := likedb.FindCount(ctx, p1)
+	assert.Equal(t, 1, count)
+}
+
+func testFindStates(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	likedb.CreateLike(ctx, newLike("u1", "p1", "love"))
+	likedb.CreateLike(ctx, newLike("u2", "p1", ""))
+	likedb.CreateLike(ctx, newLike("u2", "p2", ""))
+
+	states, err := likedb.FindStates(ctx, "post", []string{"p2", "p1", "p3"}, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, []LikeState{
+		{Targetid: "p2", Count: 1},
+		{Targetid: "p1", Count: 2, Liked: true, Reaction: "love"},
+		{Targetid: "p3"},
+	}, states)
+
+	states, err = likedb.FindStates(ctx, "post", []string{"p1"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []LikeState{{Targetid: "p1", Count: 2}}, states)
+}
+
+func testCountSince(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	now := time.Now()
+	for i, uid := range []string{"u1", "u2", "u3"} {
+		like := newLike(uid, "p1", "")
+		like.Created = now.Add(time.Duration(i-2) * time.Hour)
+		likedb.CreateLike(ctx, like)
+	}
+	likedb.CreateLike(ctx, newLike("u1", "p2", ""))
+
+	count, err := likedb.CountSince(ctx, Target{Type: "post", Id: "p1"}, now.Add(-90*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, _ = likedb.CountSince(ctx, Target{Type: "post", Id: "p1"}, now.Add(-3*time.Hour))
+	assert.Equal(t, 3, count)
+	count, _ = likedb.CountSince(ctx, Target{Type: "post", Id: "p1"}, now.Add(time.Minute))
+	assert.Equal(t, 0, count)
+
+	_, err = likedb.CountSince(ctx, Target{Type: "nope", Id: "p1"}, now)
+	assert.Equal(t, ErrInvalidTargetType, err)
+}
+
+func testCountByTarget(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	likedb.CreateLike(ctx, newLike("u1", "p1", "love"))
+	likedb.CreateLike(ctx, newLike("u2", "p1", ""))
+	likedb.CreateLike(ctx, newLike("u1", "p2", ""))
+	likedb.CreateLike(ctx, newLike("u1", "p4", ""))
+	comment := newLike("u1", "p1", "")
+	comment.Targettype = "comment"
+	likedb.CreateLike(ctx, comment)
+
+	counts, err := likedb.CountByTarget(ctx, "post", []string{"p1", "p2", "p3"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"p1": 2, "p2": 1, "p3": 0}, counts)
+
+	counts, err = likedb.CountByTarget(ctx, "post", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{}, counts)
+
+	_, err = likedb.CountByTarget(ctx, "nope", []string{"p1"})
+	assert.Equal(t, ErrInvalidTargetType, err)
+}
+
+func testFindLikersPages(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+	for _, uid := range []string{"u1", "u2", "u3"} {
+		_, err := likedb.CreateLike(ctx, newLike(uid, "p1", ""))
+		assert.NoError(t, err)
+	}
+
+	likers, next, err := likedb.FindLikers(ctx, target, "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, likers, 2)
+	assert.Equal(t, "u3", likers[0].Uid)
+	assert.Equal(t, "u2", likers[1].Uid)
+	assert.NotEqual(t, "", next)
+
+	likers, next, err = likedb.FindLikers(ctx, target, next, 2)
+	assert.NoError(t, err)
+	assert.Len(t, likers, 1)
+	assert.Equal(t, "u1", likers[0].Uid)
+	assert.Equal(t, "", next)
+
+	likes, _, err := likedb.FindUserLike(ctx, "u2", "", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, likes, 1)
+	assert.Equal(t, "p1", likes[0].Targetid)
+
+	for _, limit := range []int{0, -1} {
+		_, _, err = likedb.FindLikers(ctx, target, "", limit)
+		assert.Equal(t, ErrInvalidLimit, err)
+		_, _, err = likedb.FindUserLike(ctx, "u2", "", "", limit)
+		assert.Equal(t, ErrInvalidLimit, err)
+	}
+}
+
+func testFindLike(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+	like := newLike("u1", "p1", "love")
+	_, err := likedb.CreateLike(ctx, like)
+	assert.NoError(t, err)
+
+	found, liked, err := likedb.FindLike(ctx, target, "u1")
+	assert.NoError(t, err)
+	assert.True(t, liked)
+	assert.Equal(t, like.Likeid, found.Likeid)
+	assert.Equal(t, "u1", found.Uid)
+	assert.Equal(t, "love", found.Reaction)
+	assert.WithinDuration(t, like.Created, found.Created, time.Millisecond)
+
+	_, liked, err = likedb.FindLike(ctx, target, "u2")
+	assert.NoError(t, err)
+	assert.False(t, liked)
+	_, _, err = likedb.FindLike(ctx, Target{Type: "photo", Id: "p1"}, "u1")
+	assert.Equal(t, ErrInvalidTargetType, err)
+}
+
+func testInvalidLike(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	_, err := likedb.CreateLike(ctx, newLike("u1", "p1", "meh"))
+	assert.Equal(t, ErrInvalidReaction, err)
+	_, err = likedb.CreateLike(ctx, newLike("", "p1", ""))
+	assert.Equal(t, ErrMissingUid, err)
+	like := newLike("u1", "p1", "")
+	like.Targettype = "photo"
+	_, err = likedb.CreateLike(ctx, like)
+	assert.Equal(t, ErrInvalidTargetType, err)
+
+	count, _, err := likedb.FindCount(ctx, Target{Type: "post", Id: "p1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func testSetLikeVersion(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+
+	version, err := likedb.SetLike(ctx, newLike("u1", "p1", ""), true, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	version, err = likedb.SetLike(ctx, newLike("u1", "p1", ""), false, 0)
+	assert.Equal(t, ErrVersionConflict, err)
+	assert.Equal(t, 1, version)
+	count, _, _ := likedb.FindCount(ctx, target)
+	assert.Equal(t, 1, count)
+
+	version, err = likedb.SetLike(ctx, newLike("u1", "p1", ""), false, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	count, _, _ = likedb.FindCount(ctx, target)
+	assert.Equal(t, 0, count)
+}
+
+func testEveryChangeMovesVersion(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	target := Target{Type: "post", Id: "p1"}
+	version := func() int {
+		current, err := likedb.FindVersion(ctx, target, "u1")
+		assert.NoError(t, err)
+		return current
+	}
+
+	assert.Equal(t, 0, version())
+	likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	assert.Equal(t, 1, version())
+	// liking again with the same reaction changes nothing
+	likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	assert.Equal(t, 1, version())
+	likedb.CreateLike(ctx, newLike("u1", "p1", "love"))
+	assert.Equal(t, 2, version())
+
+	// so a set state expecting the version from before the change conflicts
+	_, err := likedb.SetLike(ctx, newLike("u1", "p1", ""), false, 1)
+	assert.Equal(t, ErrVersionConflict, err)
+
+	likedb.DeleteLike(ctx, target, "u1")
+	assert.Equal(t, 3, version())
+	likedb.DeleteLike(ctx, target, "u1")
+	assert.Equal(t, 3, version())
+
+	likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	likedb.DeleteUserLikes(ctx, "u1")
+	assert.Equal(t, 5, version())
+	likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	likedb.DeleteTargetLikes(ctx, target)
+	assert.Equal(t, 7, version())
+
+	// an invalid change uses up no version
+	_, err = likedb.SetLike(ctx, newLike("u1", "p1", "meh"), true, 7)
+	assert.Equal(t, ErrInvalidReaction, err)
+	assert.Equal(t, 7, version())
+	current, err := likedb.SetLike(ctx, newLike("u1", "p1", ""), true, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, current)
+}
+
+func testDeleteUserAndTargetLikes(t *testing.T, likedb LikeDatabase) {
+
+	ctx := context.Background()
+	likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+	likedb.CreateLike(ctx, newLike("u1", "p2", ""))
+	likedb.CreateLike(ctx, newLike("u2", "p2", ""))
+
+	deleted, err := likedb.DeleteUserLikes(ctx, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	count, reactions, _ := likedb.FindCount(ctx, Target{Type: "post", Id: "p2"})
+	assert.Equal(t, 1, count)
+	assert.Equal(t, map[string]int{"like": 1}, reactions)
+	count, _, _ = likedb.FindCount(ctx, Target{Type: "post", Id: "p1"})
+	assert.Equal(t, 0, count)
+
+	deleted, err = likedb.DeleteTargetLikes(ctx, Target{Type: "post", Id: "p2"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	count, _, _ = likedb.FindCount(ctx, Target{Type: "post", Id: "p2"})
+	assert.Equal(t, 0, count)
+}
+
+func TestLikeUniqueIndexes(t *testing.T) {
+
+	db := helpers.NewMemoryDatabase()
+	likedb := NewLikeDatabase(db)
+	ctx := context.Background()
+	assert.NoError(t, likedb.EnsureIndexes(ctx))
+
+	assert.NoError(t, db.Insert(ctx, "like", newLike("u1", "p1", "")))
+	err := db.Insert(ctx, "like", newLike("u1", "p1", "love"))
+	assert.True(t, errors.Is(err, helpers.ErrDuplicate))
+	assert.NoError(t, db.Insert(ctx, "like", newLike("u2", "p1", "")))
+
+	counter := LikeCount{Targettype: "post", Targetid: "p1", Count: 1}
+	assert.NoError(t, db.Insert(ctx, "likecount", counter))
+	err = db.Insert(ctx, "likecount", counter)
+	assert.True(t, errors.Is(err, helpers.ErrDuplicate))
+}
+
+// failingWrites is a DatabaseHelper whose like writes fail.
+type failingWrites struct {
+	helpers.DatabaseHelper
+}
+
+func (db failingWrites) FindAndUpsert(ctx context.Context, collectionName string, filter helpers.Filter, data interface{}, previous interface{}) (bool, error) {
+	return false, helpers.ErrUnavailable
+}
+
+func TestSetLikeReleasesVersion(t *testing.T) {
+
+	ctx := context.Background()
+	db := helpers.NewMemoryDatabase()
+	likedb := NewLikeDatabase(db)
+	assert.NoError(t, likedb.EnsureIndexes(ctx))
+	likedb.CreateLike(ctx, newLike("u1", "p1", ""))
+
+	// a change that fails to write gives its version back
+	_, err := NewLikeDatabase(failingWrites{db}).SetLike(ctx, newLike("u1", "p1", "love"), true, 1)
+	assert.Equal(t, helpers.ErrUnavailable, err)
+	version, _ := likedb.FindVersion(ctx, Target{Type: "post", Id: "p1"}, "u1")
+	assert.Equal(t, 1, version)
+
+	version, err = likedb.SetLike(ctx, newLike("u1", "p1", "love"), true, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+}
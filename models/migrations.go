@@ -0,0 +1,195 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vinhut/like-service/helpers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// legacyLike is a record of the postlike and commentlike collections that
+// held likes before they were stored per target in the like collection. The
+// target id field is decoded from both postid and commentid.
+type legacyLike struct {
+	Likeid    primitive.ObjectID `bson:"_id, omitempty"`
+	Uid       string
+	Postid    string
+	Commentid string
+	Reaction  string
+	Created   time.Time
+}
+
+// how many legacy likes a round trip of the migration reads
+const MIGRATION_BATCH_SIZE = 500
+
+var legacy_collections = []struct {
+	collection string
+	targettype string
+}{
+	{"postlike", "post"},
+	{"commentlike", "comment"},
+}
+
+// MigrateLegacyLikes copies the likes of the postlike and commentlike
+// collections into the like collection, then reconciles the counter of every
+// target it saw. Duplicate likes of a user on a target collapse into the
+// earliest one, likes recorded before reactions existed get the default
+// reaction, and likes already in the like collection are left untouched, so
+// the migration can be run again safely. It returns the number of likes
+// copied.
+func (likedb *likeDatabase) MigrateLegacyLikes(ctx context.Context) (int, error) {
+
+	copied := 0
+	for _, legacy := range legacy_collections {
+		collection_copied, err := likedb.migrateCollection(ctx, legacy.collection, legacy.targettype)
+		copied += collection_copied
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// migrateCollection copies the likes of a legacy collection, whose likes
+// are all of targettype, and returns how many it copied.
+func (likedb *likeDatabase) migrateCollection(ctx context.Context, collection string, targettype string) (int, error) {
+
+	// oldest first, so duplicates collapse into the earliest like
+	opts := helpers.FindOptions{
+		Sort:      []helpers.SortField{helpers.Asc("created")},
+		BatchSize: MIGRATION_BATCH_SIZE,
+	}
+	cursor, err := likedb.db.Find(ctx, collection, helpers.All(), opts)
+	if err != nil {
+		fmt.Println("model migrate error ", err)
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	copied := 0
+	targets := make(map[string]bool)
+	for cursor.Next(ctx) {
+		legacy_like := legacyLike{}
+		if decode_err := cursor.Decode(&legacy_like); decode_err != nil {
+			return copied, decode_err
+		}
+		targetid := legacy_like.Postid
+		if targettype == "comment" {
+			targetid = legacy_like.Commentid
+		}
+		target := Target{Type: targettype, Id: targetid}
+		targets[targetid] = true
+
+		existing := Like{}
+		query_err := likedb.db.Query(ctx, "like", likeQuery(target, legacy_like.Uid), &existing)
+		if query_err == nil {
+			continue
+		}
+		if !errors.Is(query_err, helpers.ErrNotFound) {
+			return copied, query_err
+		}
+
+		like := Like{
+			Likeid:     legacy_like.Likeid,
+			Uid:        legacy_like.Uid,
+			Targettype: target.Type,
+			Targetid:   target.Id,
+			Reaction:   reactionOf(legacy_like.Reaction),
+			Created:    legacy_like.Created,
+		}
+		insert_err := likedb.db.Insert(ctx, "like", like)
+		if insert_err != nil {
+			return copied, insert_err
+		}
+		copied++
+	}
+	if cursor_err := cursor.Err(); cursor_err != nil {
+		return copied, cursor_err
+	}
+
+	for targetid := range targets {
+		_, reconcile_err := likedb.ReconcileCount(ctx, Target{Type: targettype, Id: targetid})
+		if reconcile_err != nil {
+			return copied, reconcile_err
+		}
+	}
+	return copied, nil
+}
+
+// likeGroup is a group of the likes of a user on a target, of an
+// aggregation by user and target.
+type likeGroup struct {
+	Uid        string
+	Targettype string
+	Targetid   string
+	Count      int
+}
+
+// DedupeLikes removes the duplicate likes of a user on a target that were
+// written while the like collection had no unique index, keeping the
+// earliest, and reconciles the counters of their targets. Only the surplus
+// likes are deleted, by id, so an interrupted run loses no like and can be
+// run again. It must run before EnsureIndexes can build the unique indexes
+// on such data, and returns the number of likes removed.
+func (likedb *likeDatabase) DedupeLikes(ctx context.Context) (int, error) {
+
+	groups := []likeGroup{}
+	aggregation := helpers.Aggregation{GroupBy: []string{"uid", "targettype", "targetid"}}
+	err := likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+		return likedb.db.Aggregate(ctx, "like", aggregation)
+	}, func(cursor helpers.Cursor) error {
+		group := likeGroup{}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+		if group.Count > 1 {
+			groups = append(groups, group)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("model dedupe error ", err)
+		return 0, err
+	}
+
+	removed := 0
+	for _, group := range groups {
+		target := Target{Type: group.Targettype, Id: group.Targetid}
+		surplus := []primitive.ObjectID{}
+		opts := helpers.FindOptions{
+			Sort:       []helpers.SortField{helpers.Asc("created"), helpers.Asc("_id")},
+			Skip:       1,
+			Projection: []string{"_id"},
+		}
+		err := likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+			return likedb.db.Find(ctx, "like", likeQuery(target, group.Uid), opts)
+		}, func(cursor helpers.Cursor) error {
+			like := Like{}
+			if err := cursor.Decode(&like); err != nil {
+				return err
+			}
+			surplus = append(surplus, like.Likeid)
+			return nil
+		})
+		if err != nil {
+			fmt.Println("model dedupe error ", err)
+			return removed, err
+		}
+		for _, likeid := range surplus {
+			deleted, delete_err := likedb.db.Delete(ctx, "like", helpers.Eq("_id", likeid))
+			if delete_err != nil {
+				return removed, delete_err
+			}
+			if deleted {
+				removed++
+			}
+		}
+		if _, reconcile_err := likedb.ReconcileCount(ctx, target); reconcile_err != nil {
+			return removed, reconcile_err
+		}
+	}
+	return removed, nil
+}
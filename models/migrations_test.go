@@ -0,0 +1,85 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinhut/like-service/helpers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMigrateLegacyLikes(t *testing.T) {
+
+	db := helpers.NewMemoryDatabase()
+	likedb := NewLikeDatabase(db)
+	ctx := context.Background()
+	now := time.Now()
+
+	legacy := []legacyLike{
+		{Uid: "u1", Postid: "p1", Reaction: "love", Created: now.Add(time.Minute)},
+		// the earlier of two likes of u1 on p1 wins
+		{Uid: "u1", Postid: "p1", Created: now},
+		{Uid: "u2", Postid: "p1", Created: now},
+	}
+	for _, legacy_like := range legacy {
+		legacy_like.Likeid = primitive.NewObjectID()
+		assert.NoError(t, db.Insert(ctx, "postlike", legacy_like))
+	}
+	assert.NoError(t, db.Insert(ctx, "commentlike", legacyLike{Likeid: primitive.NewObjectID(), Uid: "u1", Commentid: "c1", Created: now}))
+
+	copied, err := likedb.MigrateLegacyLikes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, copied)
+
+	count, reactions, _ := likedb.FindCount(ctx, Target{Type: "post", Id: "p1"})
+	assert.Equal(t, 2, count)
+	assert.Equal(t, map[string]int{"like": 2}, reactions)
+	count, _, _ = likedb.FindCount(ctx, Target{Type: "comment", Id: "c1"})
+	assert.Equal(t, 1, count)
+
+	// running it again copies nothing
+	copied, err = likedb.MigrateLegacyLikes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, copied)
+}
+
+func TestDedupeLikes(t *testing.T) {
+
+	db := helpers.NewMemoryDatabase()
+	likedb := NewLikeDatabase(db)
+	ctx := context.Background()
+	now := time.Now()
+
+	// written before the like collection had its unique index
+	earliest := newLike("u1", "p1", "love")
+	earliest.Created = now
+	later := newLike("u1", "p1", "")
+	later.Created = now.Add(time.Minute)
+	for _, like := range []Like{later, earliest, newLike("u1", "p1", "sad"), newLike("u2", "p1", "")} {
+		if like.Created.IsZero() {
+			like.Created = now.Add(time.Hour)
+		}
+		assert.NoError(t, db.Insert(ctx, "like", like))
+	}
+	assert.Error(t, likedb.EnsureIndexes(ctx))
+
+	removed, err := likedb.DedupeLikes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	kept, liked, _ := likedb.FindLike(ctx, Target{Type: "post", Id: "p1"}, "u1")
+	assert.True(t, liked)
+	assert.Equal(t, earliest.Likeid, kept.Likeid)
+	assert.Equal(t, "love", kept.Reaction)
+	count, reactions, _ := likedb.FindCount(ctx, Target{Type: "post", Id: "p1"})
+	assert.Equal(t, 2, count)
+	assert.Equal(t, map[string]int{"like": 1, "love": 1}, reactions)
+
+	// the unique indexes build once the duplicates are gone
+	assert.NoError(t, likedb.EnsureIndexes(ctx))
+	removed, err = likedb.DedupeLikes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+
+	"github.com/vinhut/like-service/helpers"
+)
+
+// DEFAULT_REACTION is the reaction of a plain like, and of every like
+// recorded before reactions existed.
+const DEFAULT_REACTION = "like"
+
+var REACTIONS = []string{DEFAULT_REACTION, "love", "laugh", "sad", "angry"}
+
+func ValidReaction(reaction string) bool {
+	for _, r := range REACTIONS {
+		if r == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+// reactionOf is the reaction a stored like counts as: the default one for
+// a like stored without a reaction, or with one no longer known, so that
+// writes, deletes and recounts move the same counters.
+func reactionOf(reaction string) string {
+	if !ValidReaction(reaction) {
+		return DEFAULT_REACTION
+	}
+	return reaction
+}
+
+// counterDeltas returns the counter increments for a like going from the
+// previous reaction to the next one, where an empty reaction means there is
+// no like at all.
+func counterDeltas(previous string, next string) map[string]int {
+	deltas := map[string]int{}
+	if previous == next {
+		return deltas
+	}
+	if previous != "" {
+		deltas["reactions."+previous]--
+	} else {
+		deltas["count"]++
+	}
+	if next != "" {
+		deltas["reactions."+next]++
+	} else {
+		deltas["count"]--
+	}
+	return deltas
+}
+
+// reactionCount is a group of likes of an aggregation by reaction.
+type reactionCount struct {
+	Reaction string
+	Count    int
+}
+
+// countReactions counts the likes matching query per reaction, with one
+// aggregation. Likes stored without a reaction, or with one no longer known,
+// are counted as the default one.
+func (likedb *likeDatabase) countReactions(ctx context.Context, collectionName string, query helpers.Filter) (int, map[string]int, error) {
+
+	total := 0
+	reactions := map[string]int{}
+	aggregation := helpers.Aggregation{Match: query, GroupBy: []string{"reaction"}}
+	err := likedb.eachDoc(ctx, func() (helpers.Cursor, error) {
+		return likedb.db.Aggregate(ctx, collectionName, aggregation)
+	}, func(cursor helpers.Cursor) error {
+		group := reactionCount{}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+		reaction := group.Reaction
+		if !ValidReaction(reaction) {
+			reaction = DEFAULT_REACTION
+		}
+		reactions[reaction] += group.Count
+		total += group.Count
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return total, reactions, nil
+}
+
+func nonZero(reactions map[string]int) map[string]int {
+	result := map[string]int{}
+	for reaction, count := range reactions {
+		if count != 0 {
+			result[reaction] = count
+		}
+	}
+	return result
+}
@@ -0,0 +1,669 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/vinhut/like-service/helpers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqlLikeDatabase is the LikeDatabase of an embedded SQL database, for
+// deployments without a MongoDB. Likes are rows unique per user and target,
+// and the counters are kept per reaction in like_counts, updated in the same
+// transaction as the likes.
+type sqlLikeDatabase struct {
+	db *sql.DB
+}
+
+// sqlQueryer is what queries need of a *sql.DB or a *sql.Tx.
+type sqlQueryer interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+// NewSQLLikeDatabase stores likes in db, which EnsureIndexes migrates to the
+// latest schema.
+func NewSQLLikeDatabase(db *sql.DB) LikeDatabase {
+	return &sqlLikeDatabase{
+		db: db,
+	}
+}
+
+const like_columns = "id, uid, targettype, targetid, reaction, created"
+
+func scanLikes(rows *sql.Rows) ([]Like, error) {
+
+	defer rows.Close()
+	likes := []Like{}
+	for rows.Next() {
+		like := Like{}
+		id := ""
+		created := int64(0)
+		if err := rows.Scan(&id, &like.Uid, &like.Targettype, &like.Targetid, &like.Reaction, &created); err != nil {
+			return nil, err
+		}
+		likeid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, err
+		}
+		like.Likeid = likeid
+		like.Reaction = reactionOf(like.Reaction)
+		like.Created = fromUnixMillis(created)
+		likes = append(likes, like)
+	}
+	return likes, rows.Err()
+}
+
+// placeholders returns n comma separated parameters, for an in clause.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (likedb *sqlLikeDatabase) FindCount(ctx context.Context, target Target) (int, map[string]int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, nil, ErrInvalidTargetType
+	}
+	rows, err := likedb.db.QueryContext(ctx,
+		"select reaction, count from like_counts where targettype = ? and targetid = ?",
+		target.Type, target.Id)
+	if err != nil {
+		return 0, nil, helpers.SQLError(ctx, err)
+	}
+	defer rows.Close()
+
+	total := 0
+	reactions := map[string]int{}
+	for rows.Next() {
+		reaction := ""
+		count := 0
+		if err := rows.Scan(&reaction, &count); err != nil {
+			return 0, nil, helpers.SQLError(ctx, err)
+		}
+		// a reaction no longer known counts as the default one, as in the
+		// MongoDB model
+		if !ValidReaction(reaction) {
+			reaction = DEFAULT_REACTION
+		}
+		total += count
+		reactions[reaction] += count
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, helpers.SQLError(ctx, err)
+	}
+	return total, nonZero(reactions), nil
+}
+
+func (likedb *sqlLikeDatabase) CountSince(ctx context.Context, target Target, since time.Time) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
+	}
+	count := 0
+	err := likedb.db.QueryRowContext(ctx,
+		"select count(*) from likes where targettype = ? and targetid = ? and created >= ?",
+		target.Type, target.Id, unixMillis(since)).Scan(&count)
+	if err != nil {
+		return 0, helpers.SQLError(ctx, err)
+	}
+	return count, nil
+}
+
+func (likedb *sqlLikeDatabase) CountByTarget(ctx context.Context, targettype string, targetids []string) (map[string]int, error) {
+
+	if !ValidTargetType(targettype) {
+		return nil, ErrInvalidTargetType
+	}
+	counts := make(map[string]int, len(targetids))
+	if len(targetids) == 0 {
+		return counts, nil
+	}
+	args := []interface{}{targettype}
+	for _, targetid := range targetids {
+		counts[targetid] = 0
+		args = append(args, targetid)
+	}
+
+	rows, err := likedb.db.QueryContext(ctx,
+		"select targetid, count(*) from likes where targettype = ? and targetid in ("+placeholders(len(targetids))+") group by targetid",
+		args...)
+	if err != nil {
+		return nil, helpers.SQLError(ctx, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		targetid := ""
+		count := 0
+		if err := rows.Scan(&targetid, &count); err != nil {
+			return nil, helpers.SQLError(ctx, err)
+		}
+		counts[targetid] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, helpers.SQLError(ctx, err)
+	}
+	return counts, nil
+}
+
+func (likedb *sqlLikeDatabase) FindReaction(ctx context.Context, target Target, userid string) (string, error) {
+
+	likedata, liked, err := likedb.FindLike(ctx, target, userid)
+	if err != nil || !liked {
+		return "", err
+	}
+	return likedata.Reaction, nil
+}
+
+func (likedb *sqlLikeDatabase) FindLike(ctx context.Context, target Target, userid string) (Like, bool, error) {
+
+	if !ValidTargetType(target.Type) {
+		return Like{}, false, ErrInvalidTargetType
+	}
+	rows, err := likedb.db.QueryContext(ctx,
+		"select "+like_columns+" from likes where uid = ? and targettype = ? and targetid = ?",
+		userid, target.Type, target.Id)
+	if err != nil {
+		return Like{}, false, helpers.SQLError(ctx, err)
+	}
+	likes, err := scanLikes(rows)
+	if err != nil {
+		return Like{}, false, helpers.SQLError(ctx, err)
+	}
+	if len(likes) == 0 {
+		return Like{}, false, nil
+	}
+	return likes[0], true, nil
+}
+
+// findReaction returns the reaction userid left on target, empty when none.
+func findReaction(ctx context.Context, q sqlQueryer, target Target, userid string) (string, error) {
+	reaction := ""
+	err := q.QueryRowContext(ctx,
+		"select reaction from likes where uid = ? and targettype = ? and targetid = ?",
+		userid, target.Type, target.Id).Scan(&reaction)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return reactionOf(reaction), nil
+}
+
+// moveCount moves one like of target from the previous reaction to the next
+// one, where an empty reaction means no like at all.
+func moveCount(ctx context.Context, q sqlQueryer, target Target, previous string, next string) error {
+
+	if previous == next {
+		return nil
+	}
+	if previous != "" {
+		_, err := q.ExecContext(ctx,
+			"update like_counts set count = count - 1 where targettype = ? and targetid = ? and reaction = ?",
+			target.Type, target.Id, previous)
+		if err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx,
+			"delete from like_counts where targettype = ? and targetid = ? and reaction = ? and count <= 0",
+			target.Type, target.Id, previous)
+		if err != nil {
+			return err
+		}
+	}
+	if next != "" {
+		_, err := q.ExecContext(ctx,
+			`insert into like_counts (targettype, targetid, reaction, count) values (?, ?, ?, 1)
+			on conflict (targettype, targetid, reaction) do update set count = count + 1`,
+			target.Type, target.Id, next)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createLike stores a valid like and keeps the counters of its target in
+// step, reporting whether the reaction of the user changed. Repeating the
+// reaction the user left keeps the like as it is, created time included.
+func createLike(ctx context.Context, q sqlQueryer, like Like) (bool, error) {
+
+	target := Target{Type: like.Targettype, Id: like.Targetid}
+	previous, err := findReaction(ctx, q, target, like.Uid)
+	if err != nil || previous == like.Reaction {
+		return false, err
+	}
+	if like.Likeid.IsZero() {
+		like.Likeid = primitive.NewObjectIDFromTimestamp(like.Created)
+	}
+	_, err = q.ExecContext(ctx,
+		`insert into likes (`+like_columns+`) values (?, ?, ?, ?, ?, ?)
+		on conflict (uid, targettype, targetid) do update set reaction = excluded.reaction, created = excluded.created`,
+		like.Likeid.Hex(), like.Uid, like.Targettype, like.Targetid, like.Reaction, unixMillis(like.Created))
+	if err != nil {
+		return false, err
+	}
+	return previous != like.Reaction, moveCount(ctx, q, target, previous, like.Reaction)
+}
+
+// deleteLike deletes the like of userid on target and keeps the counters in
+// step, reporting whether there was a like.
+func deleteLike(ctx context.Context, q sqlQueryer, target Target, userid string) (bool, error) {
+
+	previous, err := findReaction(ctx, q, target, userid)
+	if err != nil || previous == "" {
+		return false, err
+	}
+	_, err = q.ExecContext(ctx,
+		"delete from likes where uid = ? and targettype = ? and targetid = ?",
+		userid, target.Type, target.Id)
+	if err != nil {
+		return false, err
+	}
+	return true, moveCount(ctx, q, target, previous, "")
+}
+
+// findVersion returns the version of the like of userid on target, 0 for a
+// like never changed.
+func findVersion(ctx context.Context, q sqlQueryer, target Target, userid string) (int, error) {
+	version := 0
+	err := q.QueryRowContext(ctx,
+		"select version from like_versions where uid = ? and targettype = ? and targetid = ?",
+		userid, target.Type, target.Id).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// setVersion stores the version of the like of userid on target.
+func setVersion(ctx context.Context, q sqlQueryer, target Target, userid string, version int) error {
+	_, err := q.ExecContext(ctx,
+		`insert into like_versions (uid, targettype, targetid, version) values (?, ?, ?, ?)
+		on conflict (uid, targettype, targetid) do update set version = excluded.version`,
+		userid, target.Type, target.Id, version)
+	return err
+}
+
+// bumpVersion counts a change of the like of userid on target, so a SetLike
+// expecting the version from before the change conflicts.
+func bumpVersion(ctx context.Context, q sqlQueryer, target Target, userid string) error {
+	_, err := q.ExecContext(ctx,
+		`insert into like_versions (uid, targettype, targetid, version) values (?, ?, ?, 1)
+		on conflict (uid, targettype, targetid) do update set version = version + 1`,
+		userid, target.Type, target.Id)
+	return err
+}
+
+func (likedb *sqlLikeDatabase) CreateLike(ctx context.Context, like Like) (bool, error) {
+
+	if err := validLike(like); err != nil {
+		return false, err
+	}
+	like.Reaction = reactionOf(like.Reaction)
+	target := Target{Type: like.Targettype, Id: like.Targetid}
+	err := transact(ctx, likedb.db, func(tx *sql.Tx) error {
+		changed, err := createLike(ctx, tx, like)
+		if err != nil || !changed {
+			return err
+		}
+		return bumpVersion(ctx, tx, target, like.Uid)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (likedb *sqlLikeDatabase) DeleteLike(ctx context.Context, target Target, userid string) (bool, error) {
+
+	if !ValidTargetType(target.Type) {
+		return false, ErrInvalidTargetType
+	}
+	err := transact(ctx, likedb.db, func(tx *sql.Tx) error {
+		changed, err := deleteLike(ctx, tx, target, userid)
+		if err != nil || !changed {
+			return err
+		}
+		return bumpVersion(ctx, tx, target, userid)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (likedb *sqlLikeDatabase) FindVersion(ctx context.Context, target Target, userid string) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
+	}
+	version, err := findVersion(ctx, likedb.db, target, userid)
+	if err != nil {
+		return 0, helpers.SQLError(ctx, err)
+	}
+	return version, nil
+}
+
+// SetLike checks the version and changes the like in one transaction, so a
+// failed change does not use up a version.
+func (likedb *sqlLikeDatabase) SetLike(ctx context.Context, like Like, liked bool, expected int) (int, error) {
+
+	if liked {
+		if err := validLike(like); err != nil {
+			return 0, err
+		}
+	} else if !ValidTargetType(like.Targettype) {
+		return 0, ErrInvalidTargetType
+	}
+	like.Reaction = reactionOf(like.Reaction)
+	target := Target{Type: like.Targettype, Id: like.Targetid}
+
+	version := 0
+	err := transact(ctx, likedb.db, func(tx *sql.Tx) error {
+		var err error
+		if version, err = findVersion(ctx, tx, target, like.Uid); err != nil {
+			return err
+		}
+		if expected >= 0 && version != expected {
+			return ErrVersionConflict
+		}
+		version++
+		if err := setVersion(ctx, tx, target, like.Uid, version); err != nil {
+			return err
+		}
+		if liked {
+			_, err = createLike(ctx, tx, like)
+		} else {
+			_, err = deleteLike(ctx, tx, target, like.Uid)
+		}
+		return err
+	})
+	if errors.Is(err, ErrVersionConflict) {
+		return version, ErrVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func (likedb *sqlLikeDatabase) FindStates(ctx context.Context, targettype string, targetids []string, userid string) ([]LikeState, error) {
+
+	if !ValidTargetType(targettype) {
+		return nil, ErrInvalidTargetType
+	}
+	states := make([]LikeState, len(targetids))
+	if len(targetids) == 0 {
+		return states, nil
+	}
+	args := []interface{}{targettype}
+	for _, targetid := range targetids {
+		args = append(args, targetid)
+	}
+
+	rows, err := likedb.db.QueryContext(ctx,
+		"select targetid, sum(count) from like_counts where targettype = ? and targetid in ("+placeholders(len(targetids))+") group by targetid",
+		args...)
+	if err != nil {
+		return nil, helpers.SQLError(ctx, err)
+	}
+	counts := map[string]int{}
+	for rows.Next() {
+		targetid := ""
+		count := 0
+		if err := rows.Scan(&targetid, &count); err != nil {
+			rows.Close()
+			return nil, helpers.SQLError(ctx, err)
+		}
+		counts[targetid] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, helpers.SQLError(ctx, err)
+	}
+
+	reactions := map[string]string{}
+	if userid != "" {
+		rows, err := likedb.db.QueryContext(ctx,
+			"select "+like_columns+" from likes where uid = ? and targettype = ? and targetid in ("+placeholders(len(targetids))+")",
+			append([]interface{}{userid}, args...)...)
+		if err != nil {
+			return nil, helpers.SQLError(ctx, err)
+		}
+		likes, err := scanLikes(rows)
+		if err != nil {
+			return nil, helpers.SQLError(ctx, err)
+		}
+		for _, like := range likes {
+			reactions[like.Targetid] = like.Reaction
+		}
+	}
+
+	for i, targetid := range targetids {
+		states[i] = LikeState{
+			Targetid: targetid,
+			Count:    counts[targetid],
+			Liked:    reactions[targetid] != "",
+			Reaction: reactions[targetid],
+		}
+	}
+	return states, nil
+}
+
+// findPage returns the likes matching where, newest first, limit at a time
+// after cursor, and the cursor of the next page.
+func (likedb *sqlLikeDatabase) findPage(ctx context.Context, where string, args []interface{}, cursor string, limit int) ([]Like, string, error) {
+
+	if limit < 1 {
+		return nil, "", ErrInvalidLimit
+	}
+	before, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if !before.IsZero() {
+		where += " and id < ?"
+		args = append(args, before.Hex())
+	}
+	rows, err := likedb.db.QueryContext(ctx,
+		"select "+like_columns+" from likes where "+where+" order by id desc limit ?",
+		append(args, limit+1)...)
+	if err != nil {
+		return nil, "", helpers.SQLError(ctx, err)
+	}
+	likes, err := scanLikes(rows)
+	if err != nil {
+		return nil, "", helpers.SQLError(ctx, err)
+	}
+
+	next := ""
+	if len(likes) > limit {
+		likes = likes[:limit]
+		next = likes[limit-1].Likeid.Hex()
+	}
+	return likes, next, nil
+}
+
+func (likedb *sqlLikeDatabase) FindLikers(ctx context.Context, target Target, cursor string, limit int) ([]Liker, string, error) {
+
+	if !ValidTargetType(target.Type) {
+		return nil, "", ErrInvalidTargetType
+	}
+	likes, next, err := likedb.findPage(ctx, "targettype = ? and targetid = ?", []interface{}{target.Type, target.Id}, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	likers := make([]Liker, 0, len(likes))
+	for _, like := range likes {
+		likers = append(likers, Liker{Uid: like.Uid, Reaction: like.Reaction, Created: like.Created})
+	}
+	return likers, next, nil
+}
+
+func (likedb *sqlLikeDatabase) FindUserLike(ctx context.Context, userid string, targettype string, cursor string, limit int) ([]UserLike, string, error) {
+
+	if targettype != "" && !ValidTargetType(targettype) {
+		return nil, "", ErrInvalidTargetType
+	}
+	where := "uid = ?"
+	args := []interface{}{userid}
+	if targettype != "" {
+		where += " and targettype = ?"
+		args = append(args, targettype)
+	}
+	likes, next, err := likedb.findPage(ctx, where, args, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	user_likes := make([]UserLike, 0, len(likes))
+	for _, like := range likes {
+		user_likes = append(user_likes, UserLike{
+			Likeid:   like.Likeid,
+			Type:     like.Targettype,
+			Targetid: like.Targetid,
+			Reaction: like.Reaction,
+			Created:  like.Created,
+		})
+	}
+	return user_likes, next, nil
+}
+
+// recount rebuilds the counters of target from its likes and returns the
+// total.
+func recount(ctx context.Context, q sqlQueryer, target Target) (int, error) {
+
+	_, err := q.ExecContext(ctx,
+		"delete from like_counts where targettype = ? and targetid = ?",
+		target.Type, target.Id)
+	if err != nil {
+		return 0, err
+	}
+	// counted by reactionOf, the reactions no longer known as the default
+	args := []interface{}{}
+	for _, reaction := range REACTIONS {
+		args = append(args, reaction)
+	}
+	args = append(args, DEFAULT_REACTION, target.Type, target.Id)
+	_, err = q.ExecContext(ctx,
+		`insert into like_counts (targettype, targetid, reaction, count)
+		select targettype, targetid, case when reaction in (`+placeholders(len(REACTIONS))+`) then reaction else ? end as known, count(*)
+		from likes where targettype = ? and targetid = ? group by targettype, targetid, known`,
+		args...)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	err = q.QueryRowContext(ctx,
+		"select coalesce(sum(count), 0) from like_counts where targettype = ? and targetid = ?",
+		target.Type, target.Id).Scan(&total)
+	return total, err
+}
+
+func (likedb *sqlLikeDatabase) ReconcileCount(ctx context.Context, target Target) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
+	}
+	total := 0
+	err := transact(ctx, likedb.db, func(tx *sql.Tx) error {
+		var err error
+		total, err = recount(ctx, tx, target)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func (likedb *sqlLikeDatabase) DeleteUserLikes(ctx context.Context, userid string) (int, error) {
+	return likedb.deleteLikes(ctx, "uid = ?", userid)
+}
+
+func (likedb *sqlLikeDatabase) DeleteTargetLikes(ctx context.Context, target Target) (int, error) {
+
+	if !ValidTargetType(target.Type) {
+		return 0, ErrInvalidTargetType
+	}
+	return likedb.deleteLikes(ctx, "targettype = ? and targetid = ?", target.Type, target.Id)
+}
+
+// deleteLikes removes the likes matching where in bulk, in one transaction
+// with moving their versions on and recounting the targets they were on,
+// and returns how many it removed.
+func (likedb *sqlLikeDatabase) deleteLikes(ctx context.Context, where string, args ...interface{}) (int, error) {
+
+	deleted := 0
+	err := transact(ctx, likedb.db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "select distinct targettype, targetid from likes where "+where, args...)
+		if err != nil {
+			return err
+		}
+		targets := []Target{}
+		for rows.Next() {
+			target := Target{}
+			if err := rows.Scan(&target.Type, &target.Id); err != nil {
+				rows.Close()
+				return err
+			}
+			targets = append(targets, target)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`insert into like_versions (uid, targettype, targetid, version)
+			select uid, targettype, targetid, 1 from likes where `+where+`
+			on conflict (uid, targettype, targetid) do update set version = version + 1`,
+			args...)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "delete from likes where "+where, args...)
+		if err != nil {
+			return err
+		}
+		removed, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if _, err := recount(ctx, tx, target); err != nil {
+				return err
+			}
+		}
+		deleted = int(removed)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// EnsureIndexes migrates the database to the latest schema, which has the
+// constraints and indexes the queries rely on.
+func (likedb *sqlLikeDatabase) EnsureIndexes(ctx context.Context) error {
+	_, err := MigrateSQL(ctx, likedb.db)
+	return err
+}
+
+// MigrateLegacyLikes has nothing to copy, the legacy collections only ever
+// existed in MongoDB.
+func (likedb *sqlLikeDatabase) MigrateLegacyLikes(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// DedupeLikes has nothing to remove, the likes table was unique per user and
+// target from the start.
+func (likedb *sqlLikeDatabase) DedupeLikes(ctx context.Context) (int, error) {
+	return 0, nil
+}
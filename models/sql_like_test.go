@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinhut/like-service/helpers"
+)
+
+func newTestSQLDatabase(t *testing.T) *sql.DB {
+	db, err := helpers.OpenSQLite(":memory:")
+	assert.NoError(t, err)
+	return db
+}
+
+func TestSQLLikeDatabase(t *testing.T) {
+	runConformance(t, func(t *testing.T) LikeDatabase {
+		likedb := NewSQLLikeDatabase(newTestSQLDatabase(t))
+		assert.NoError(t, likedb.EnsureIndexes(context.Background()))
+		return likedb
+	})
+}
+
+func TestMigrateSQL(t *testing.T) {
+
+	db := newTestSQLDatabase(t)
+	ctx := context.Background()
+
+	applied, err := MigrateSQL(ctx, db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(sql_migrations), applied)
+	applied, err = MigrateSQL(ctx, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, applied)
+
+	// a like is unique per user and target, whatever its id
+	insert := "insert into likes (" + like_columns + ") values (?, 'u1', 'post', 'p1', 'like', 0)"
+	_, err = db.Exec(insert, "a")
+	assert.NoError(t, err)
+	_, err = db.Exec(insert, "b")
+	assert.True(t, errors.Is(helpers.SQLError(ctx, err), helpers.ErrDuplicate))
+
+	// a database of a newer release is left alone
+	_, err = db.Exec("pragma user_version = 1000")
+	assert.NoError(t, err)
+	_, err = MigrateSQL(ctx, db)
+	assert.Error(t, err)
+}
+
+func TestSQLIdempotencyDatabase(t *testing.T) {
+
+	db := newTestSQLDatabase(t)
+	ctx := context.Background()
+	idemdb := NewSQLIdempotencyDatabase(db, time.Hour, time.Minute)
+	assert.NoError(t, idemdb.EnsureIndexes(ctx))
+
+	record, reserved, err := idemdb.Reserve(ctx, "u1", "k1", "f1")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	existing, reserved, err := idemdb.Reserve(ctx, "u1", "k1", "f2")
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, "f1", existing.Fingerprint)
+	assert.Equal(t, 0, existing.Status)
+
+	record.Status = 200
+	record.ContentType = "text/plain"
+	record.Body = []byte("Liked")
+	assert.NoError(t, idemdb.Complete(ctx, "u1", "k1", record))
+	existing, _, _ = idemdb.Reserve(ctx, "u1", "k1", "f1")
+	assert.Equal(t, 200, existing.Status)
+	assert.Equal(t, []byte("Liked"), existing.Body)
+
+	assert.NoError(t, idemdb.Release(ctx, "u1", "k1", record))
+	_, reserved, _ = idemdb.Reserve(ctx, "u1", "k1", "f1")
+	assert.True(t, reserved)
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/vinhut/like-service/helpers"
+)
+
+// sql_migrations are the steps bringing an SQL database to the schema the
+// SQL storage expects, in order. The version of a database is the number of
+// steps applied to it, kept in its user_version. Steps are only ever added
+// at the end, never changed once released.
+var sql_migrations = []string{
+	// 1: likes, one per user and target, with their counters per reaction
+	// and the versions SetLike checks
+	`create table likes (
+		id         text primary key,
+		uid        text not null,
+		targettype text not null,
+		targetid   text not null,
+		reaction   text not null,
+		created    integer not null,
+		unique (uid, targettype, targetid)
+	);
+	create index likes_target on likes (targettype, targetid, id);
+	create index likes_user on likes (uid, targettype, id);
+	create index likes_user_all on likes (uid, id);
+	create table like_counts (
+		targettype text not null,
+		targetid   text not null,
+		reaction   text not null,
+		count      integer not null,
+		primary key (targettype, targetid, reaction)
+	);
+	create table like_versions (
+		uid        text not null,
+		targettype text not null,
+		targetid   text not null,
+		version    integer not null,
+		primary key (uid, targettype, targetid)
+	);`,
+	// 2: the audit trail of admin actions and the idempotency keys
+	`create table audit (
+		id         text primary key,
+		actor      text not null,
+		role       text not null,
+		action     text not null,
+		uid        text not null,
+		targettype text not null,
+		targetid   text not null,
+		created    integer not null
+	);
+	create table idempotency (
+		uid          text not null,
+		key          text not null,
+		fingerprint  text not null,
+		status       integer not null,
+		content_type text not null,
+		body         blob,
+		created      integer not null,
+		primary key (uid, key)
+	);
+	create index idempotency_created on idempotency (created);`,
+	// 3: counting the recent likes of a target
+	`create index likes_target_created on likes (targettype, targetid, created);`,
+}
+
+// MigrateSQL applies the steps of sql_migrations db has not had yet, each in
+// its own transaction, and returns how many it applied.
+func MigrateSQL(ctx context.Context, db *sql.DB) (int, error) {
+
+	version := 0
+	if err := db.QueryRowContext(ctx, "pragma user_version").Scan(&version); err != nil {
+		return 0, helpers.SQLError(ctx, err)
+	}
+	if version > len(sql_migrations) {
+		return 0, fmt.Errorf("database schema version %d is newer than %d", version, len(sql_migrations))
+	}
+
+	applied := 0
+	for ; version < len(sql_migrations); version++ {
+		err := transact(ctx, db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, sql_migrations[version]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("pragma user_version = %d", version+1))
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migrate to schema version %d: %w", version+1, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// transact runs fn in a transaction, committed when fn returns nil and
+// rolled back otherwise.
+func transact(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return helpers.SQLError(ctx, err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return helpers.SQLError(ctx, err)
+	}
+	return helpers.SQLError(ctx, tx.Commit())
+}
+
+// unixMillis and fromUnixMillis store times as MongoDB does, to the
+// millisecond.
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC()
+}
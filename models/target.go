@@ -0,0 +1,111 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// longest target id and uid accepted
+const (
+	MAX_TARGET_ID_LENGTH = 128
+	MAX_UID_LENGTH       = 128
+)
+
+var (
+	ErrMissingTargetId = errors.New("missing target id")
+	ErrInvalidTargetId = errors.New("invalid target id")
+	ErrMissingUid      = errors.New("missing uid")
+	ErrInvalidUid      = errors.New("invalid uid")
+)
+
+// Target identifies a likeable thing: its type, such as "post" or
+// "comment", and its id within that type.
+type Target struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+var (
+	target_types_lock sync.RWMutex
+	target_types      = map[string]bool{
+		"post":    true,
+		"comment": true,
+	}
+	// the format the ids of a type must match, types without one take any id
+	target_id_formats = map[string]*regexp.Regexp{}
+)
+
+// RegisterTargetTypes makes the comma separated type names in config
+// likeable, in addition to posts and comments.
+func RegisterTargetTypes(config string) {
+	target_types_lock.Lock()
+	defer target_types_lock.Unlock()
+
+	for _, name := range strings.Split(config, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			target_types[name] = true
+		}
+	}
+}
+
+func ValidTargetType(name string) bool {
+	target_types_lock.RLock()
+	defer target_types_lock.RUnlock()
+
+	return target_types[name]
+}
+
+// RegisterTargetIdFormats sets the format the ids of a type must match.
+// config holds space separated type=regexp entries, such as
+// post=^[0-9a-f]{24}$.
+func RegisterTargetIdFormats(config string) error {
+	target_types_lock.Lock()
+	defer target_types_lock.Unlock()
+
+	for _, entry := range strings.Fields(config) {
+		name_format := strings.SplitN(entry, "=", 2)
+		if len(name_format) != 2 {
+			return errors.New("target id format must be type=regexp: " + entry)
+		}
+		format, err := regexp.Compile(name_format[1])
+		if err != nil {
+			return err
+		}
+		target_id_formats[name_format[0]] = format
+	}
+	return nil
+}
+
+// ValidTargetId checks that id is set, not too long and in the format of
+// its type.
+func ValidTargetId(targettype string, id string) error {
+	if id == "" {
+		return ErrMissingTargetId
+	}
+	if len(id) > MAX_TARGET_ID_LENGTH {
+		return ErrInvalidTargetId
+	}
+
+	target_types_lock.RLock()
+	format := target_id_formats[targettype]
+	target_types_lock.RUnlock()
+
+	if format != nil && !format.MatchString(id) {
+		return ErrInvalidTargetId
+	}
+	return nil
+}
+
+// ValidUid checks that uid is set and not too long.
+func ValidUid(uid string) error {
+	if uid == "" {
+		return ErrMissingUid
+	}
+	if len(uid) > MAX_UID_LENGTH {
+		return ErrInvalidUid
+	}
+	return nil
+}
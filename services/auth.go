@@ -1,78 +1,142 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 )
 
 var SERVICE_URL = os.Getenv("AUTH_SERVICE_URL")
 
+// bounds every call to the auth service, AUTH_SERVICE_TIMEOUT overrides it
+const DEFAULT_AUTH_SERVICE_TIMEOUT = 5 * time.Second
+
 type AuthService interface {
-	Login(service string, email string, password string) (string, error)
-	Check(service string, token string) (string, error)
+	Login(ctx context.Context, service string, email string, password string) (string, error)
+	Check(ctx context.Context, service string, token string) (string, error)
 	Update() (bool, error)
-	Create(service string, email string, password string) (bool, error)
+	Create(ctx context.Context, service string, email string, password string) (bool, error)
 	Delete(string) (bool, error)
 }
 
 type userAuthService struct {
-	token string
+	token  string
+	client *http.Client
+}
+
+func authServiceTimeout() time.Duration {
+	if env_timeout, err := time.ParseDuration(os.Getenv("AUTH_SERVICE_TIMEOUT")); err == nil {
+		return env_timeout
+	}
+	return DEFAULT_AUTH_SERVICE_TIMEOUT
 }
 
 func NewUserAuthService() AuthService {
 	return &userAuthService{
-		token: "",
+		token:  "",
+		client: &http.Client{Timeout: authServiceTimeout()},
+	}
+}
+
+// send makes a request to the auth service in a client span, a child of the
+// span in ctx, and passes the span on to the auth service in B3 headers. A
+// request that gets no response fails with ErrUnavailable.
+func (userAuth *userAuthService) send(ctx context.Context, operation string, req *http.Request) (*http.Response, error) {
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, operation)
+	defer span.Finish()
+	ext.SpanKindRPCClient.Set(span)
+	ext.HTTPMethod.Set(span, req.Method)
+	// the query may carry a token, keep it out of the trace
+	ext.HTTPUrl.Set(span, req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+	opentracing.GlobalTracer().Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+
+	resp, err := userAuth.client.Do(req.WithContext(ctx))
+	if err != nil {
+		ext.Error.Set(span, true)
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
+	return resp, nil
+}
+
+func (userAuth *userAuthService) postForm(ctx context.Context, operation string, path string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", SERVICE_URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return userAuth.send(ctx, operation, req)
 }
 
-func (userAuth *userAuthService) Login(service string, email string, password string) (string, error) {
-	resp, err := http.PostForm(SERVICE_URL+"/login",
+func (userAuth *userAuthService) Login(ctx context.Context, service string, email string, password string) (string, error) {
+	resp, err := userAuth.postForm(ctx, "auth login", "/login",
 		url.Values{"service": {service}, "email": {email}, "password": {password}})
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return string(body), nil
-	} else {
-		return "", err
+	if resp.StatusCode != 200 {
+		return "", statusError(resp, ErrRejected)
+	}
+	body, read_err := ioutil.ReadAll(resp.Body)
+	if read_err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, read_err)
 	}
+	return string(body), nil
 
 }
 
-func (userAuth *userAuthService) Check(service string, token string) (string, error) {
-	resp, err := http.Get(SERVICE_URL + "/user?service=" + service + "&token=" + token)
+func (userAuth *userAuthService) Check(ctx context.Context, service string, token string) (string, error) {
+	// the token is whatever the caller sent, so it must not reach the query
+	// unescaped
+	query := url.Values{"service": {service}, "token": {token}}
+	req, err := http.NewRequest("GET", SERVICE_URL+"/user?"+query.Encode(), nil)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return string(body), nil
-	} else {
+	resp, err := userAuth.send(ctx, "auth check", req)
+	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", statusError(resp, ErrInvalidToken)
+	}
+	body, read_err := ioutil.ReadAll(resp.Body)
+	if read_err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, read_err)
+	}
+	if !json.Valid(body) {
+		return "", ErrMalformedResponse
+	}
+	return string(body), nil
 }
 
 func (userAuth *userAuthService) Update() (bool, error) {
 	return false, nil
 }
 
-func (userAuth *userAuthService) Create(service string, email string, password string) (bool, error) {
-	resp, err := http.PostForm(SERVICE_URL+"/user",
+func (userAuth *userAuthService) Create(ctx context.Context, service string, email string, password string) (bool, error) {
+	resp, err := userAuth.postForm(ctx, "auth create", "/user",
 		url.Values{"service": {service}, "email": {email}, "password": {password}})
 	if err != nil {
 		return false, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		return true, nil
-	} else {
-		return false, err
+	if resp.StatusCode != 200 {
+		return false, statusError(resp, ErrRejected)
 	}
+	return true, nil
 
 }
 
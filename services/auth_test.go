@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckStatusErrors(t *testing.T) {
+
+	cases := []struct {
+		status int
+		body   string
+		err    error
+	}{
+		{200, `{"uid":"1"}`, nil},
+		{200, `not json`, ErrMalformedResponse},
+		{401, `invalid token`, ErrInvalidToken},
+		{401, `token expired`, ErrTokenExpired},
+		{503, ``, ErrUnavailable},
+		{302, ``, ErrMalformedResponse},
+	}
+
+	defer func(url string) { SERVICE_URL = url }(SERVICE_URL)
+	for _, test := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		SERVICE_URL = server.URL
+		user_data, err := NewUserAuthService().Check(context.Background(), "like-service", "token")
+		server.Close()
+
+		if test.err == nil {
+			assert.NoError(t, err)
+			assert.Equal(t, test.body, user_data)
+		} else {
+			assert.True(t, errors.Is(err, test.err), "status %d: %v", test.status, err)
+		}
+	}
+
+	SERVICE_URL = "http://127.0.0.1:1"
+	_, err := NewUserAuthService().Check(context.Background(), "like-service", "token")
+	assert.True(t, errors.Is(err, ErrUnavailable))
+}
+
+func TestCheckEscapesToken(t *testing.T) {
+
+	token := "abc&service=admin#x?y=1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"like-service"}, r.URL.Query()["service"])
+		assert.Equal(t, token, r.URL.Query().Get("token"))
+		w.Write([]byte(`{"uid":"1"}`))
+	}))
+	defer server.Close()
+	defer func(url string) { SERVICE_URL = url }(SERVICE_URL)
+	SERVICE_URL = server.URL
+
+	_, err := NewUserAuthService().Check(context.Background(), "like-service", token)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"golang.org/x/sync/singleflight"
+)
+
+// auth_cache_stats counts the lookups of every caching auth service, served
+// with the other expvars on the admin /debug/vars route.
+var auth_cache_stats = expvar.NewMap("auth_cache")
+
+type cachedCheck struct {
+	key       [sha256.Size]byte
+	user_data string
+	err       error
+	expires   time.Time
+}
+
+// cachingAuthService answers Check from a bounded LRU of recent checks so a
+// client sending the same token again skips the auth round trip. Accepted
+// tokens are kept for ttl, or until they expire if that is sooner, and
+// rejected ones for negative_ttl; errors that say nothing about the token,
+// such as the auth service being down, are not cached. Concurrent checks of
+// a token that is not cached share one call, bounded by the auth service
+// timeout rather than by any of the callers.
+type cachingAuthService struct {
+	next         AuthService
+	capacity     int
+	ttl          time.Duration
+	negative_ttl time.Duration
+	// bounds the shared call to next
+	timeout time.Duration
+	now     func() time.Time
+
+	lock    sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List
+	group   singleflight.Group
+}
+
+func NewCachingAuthService(next AuthService, capacity int, ttl time.Duration, negative_ttl time.Duration) AuthService {
+	return &cachingAuthService{
+		next:         next,
+		capacity:     capacity,
+		ttl:          ttl,
+		negative_ttl: negative_ttl,
+		timeout:      authServiceTimeout(),
+		now:          time.Now,
+		entries:      make(map[[sha256.Size]byte]*list.Element),
+		order:        list.New(),
+	}
+}
+
+// rejected reports whether err means the token itself is no good, so the
+// answer holds until the token changes.
+func rejected(err error) bool {
+	return errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrTokenExpired) || errors.Is(err, ErrMalformedToken)
+}
+
+func (cache *cachingAuthService) get(key [sha256.Size]byte) (*cachedCheck, bool) {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedCheck)
+	if !cache.now().Before(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return entry, true
+}
+
+func (cache *cachingAuthService) put(entry *cachedCheck) {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if element, ok := cache.entries[entry.key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[entry.key] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cachedCheck).key)
+		auth_cache_stats.Add("evictions", 1)
+	}
+}
+
+func (cache *cachingAuthService) Check(ctx context.Context, service string, token string) (string, error) {
+
+	// keep a digest rather than the token itself
+	key := sha256.Sum256([]byte(service + "\x00" + token))
+	if entry, ok := cache.get(key); ok {
+		if entry.err != nil {
+			auth_cache_stats.Add("negative_hits", 1)
+		} else {
+			auth_cache_stats.Add("hits", 1)
+		}
+		return entry.user_data, entry.err
+	}
+	auth_cache_stats.Add("misses", 1)
+
+	// the shared call outlives the caller that started it, so a caller giving
+	// up does not fail the others waiting on it; it keeps the caller's span
+	flight := cache.group.DoChan(string(key[:]), func() (interface{}, error) {
+		call_ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+		defer cancel()
+		call_ctx = opentracing.ContextWithSpan(call_ctx, opentracing.SpanFromContext(ctx))
+		user_data, err := cache.next.Check(call_ctx, service, token)
+		switch {
+		case err == nil && user_data != "":
+			expires := cache.now().Add(cache.ttl)
+			if token_expires, ok := tokenExpiry(token); ok && token_expires.Before(expires) {
+				expires = token_expires
+			}
+			cache.put(&cachedCheck{key: key, user_data: user_data, expires: expires})
+		case rejected(err):
+			cache.put(&cachedCheck{key: key, err: err, expires: cache.now().Add(cache.negative_ttl)})
+		}
+		return user_data, err
+	})
+	select {
+	case result := <-flight:
+		return result.Val.(string), result.Err
+	case <-ctx.Done():
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, ctx.Err())
+	}
+}
+
+func (cache *cachingAuthService) Login(ctx context.Context, service string, email string, password string) (string, error) {
+	return cache.next.Login(ctx, service, email, password)
+}
+
+func (cache *cachingAuthService) Update() (bool, error) {
+	return cache.next.Update()
+}
+
+func (cache *cachingAuthService) Create(ctx context.Context, service string, email string, password string) (bool, error) {
+	return cache.next.Create(ctx, service, email, password)
+}
+
+func (cache *cachingAuthService) Delete(uid string) (bool, error) {
+	return cache.next.Delete(uid)
+}
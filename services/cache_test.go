@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingCheck struct {
+	userAuthService
+	calls   int32
+	err     error
+	release chan struct{}
+}
+
+func (counting *countingCheck) Check(ctx context.Context, service string, token string) (string, error) {
+	atomic.AddInt32(&counting.calls, 1)
+	if counting.release != nil {
+		<-counting.release
+	}
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if counting.err != nil {
+		return "", counting.err
+	}
+	return `{"uid":"` + token + `"}`, nil
+}
+
+func TestCacheHitAndExpiry(t *testing.T) {
+
+	next := &countingCheck{}
+	cache := NewCachingAuthService(next, 10, time.Minute, time.Second).(*cachingAuthService)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		user_data, err := cache.Check(ctx, "like-service", "1")
+		assert.NoError(t, err)
+		assert.Equal(t, `{"uid":"1"}`, user_data)
+	}
+	assert.Equal(t, int32(1), next.calls)
+
+	now = now.Add(time.Minute)
+	cache.Check(ctx, "like-service", "1")
+	assert.Equal(t, int32(2), next.calls)
+}
+
+func TestCacheNegative(t *testing.T) {
+
+	next := &countingCheck{err: ErrInvalidToken}
+	cache := NewCachingAuthService(next, 10, time.Minute, time.Second).(*cachingAuthService)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, err := cache.Check(ctx, "like-service", "bad")
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = cache.Check(ctx, "like-service", "bad")
+	assert.Equal(t, ErrInvalidToken, err)
+	assert.Equal(t, int32(1), next.calls)
+
+	now = now.Add(time.Second)
+	cache.Check(ctx, "like-service", "bad")
+	assert.Equal(t, int32(2), next.calls)
+
+	// failures unrelated to the token are not cached
+	next.err = errors.New("connection refused")
+	cache.Check(ctx, "like-service", "other")
+	cache.Check(ctx, "like-service", "other")
+	assert.Equal(t, int32(4), next.calls)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+
+	next := &countingCheck{}
+	cache := NewCachingAuthService(next, 2, time.Minute, time.Second)
+	ctx := context.Background()
+
+	cache.Check(ctx, "like-service", "1")
+	cache.Check(ctx, "like-service", "2")
+	cache.Check(ctx, "like-service", "1")
+	cache.Check(ctx, "like-service", "3")
+	assert.Equal(t, int32(3), next.calls)
+
+	cache.Check(ctx, "like-service", "1")
+	assert.Equal(t, int32(3), next.calls)
+	cache.Check(ctx, "like-service", "2")
+	assert.Equal(t, int32(4), next.calls)
+}
+
+func TestCacheCollapsesConcurrentMisses(t *testing.T) {
+
+	next := &countingCheck{release: make(chan struct{})}
+	cache := NewCachingAuthService(next, 10, time.Minute, time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user_data, err := cache.Check(context.Background(), "like-service", "1")
+			assert.NoError(t, err)
+			assert.Equal(t, `{"uid":"1"}`, user_data)
+		}()
+	}
+	for atomic.LoadInt32(&next.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(next.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), next.calls)
+}
+
+func TestCacheCallOutlivesFirstCaller(t *testing.T) {
+
+	next := &countingCheck{release: make(chan struct{})}
+	cache := NewCachingAuthService(next, 10, time.Minute, time.Second)
+
+	// the caller starting the call gives up while it is in flight
+	first_ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := cache.Check(first_ctx, "like-service", "1")
+		first <- err
+	}()
+	for atomic.LoadInt32(&next.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiter := make(chan error)
+	go func() {
+		user_data, err := cache.Check(context.Background(), "like-service", "1")
+		assert.Equal(t, `{"uid":"1"}`, user_data)
+		waiter <- err
+	}()
+	cancel()
+	assert.True(t, errors.Is(<-first, ErrUnavailable))
+
+	// the others waiting on the call still get its answer
+	close(next.release)
+	assert.NoError(t, <-waiter)
+	assert.Equal(t, int32(1), next.calls)
+}
+
+func TestCacheKeepsTokenUntilItExpires(t *testing.T) {
+
+	next := &countingCheck{}
+	cache := NewCachingAuthService(next, 10, time.Minute, time.Second).(*cachingAuthService)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+	token := signHS256("k1", "secret", userClaims(now.Add(10*time.Second)))
+
+	cache.Check(ctx, "like-service", token)
+	cache.Check(ctx, "like-service", token)
+	assert.Equal(t, int32(1), next.calls)
+
+	// the token expires before the ttl is up
+	now = now.Add(10 * time.Second)
+	cache.Check(ctx, "like-service", token)
+	assert.Equal(t, int32(2), next.calls)
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Errors of the auth services. A token the auth service turned down is
+// ErrInvalidToken, or ErrTokenExpired when it says the token expired.
+// ErrUnavailable means the auth service could not answer, and
+// ErrMalformedResponse that it answered with something that is not user
+// data; neither says anything about the token.
+var (
+	ErrInvalidToken      = errors.New("invalid token")
+	ErrTokenExpired      = errors.New("token expired")
+	ErrRejected          = errors.New("auth service rejected the request")
+	ErrUnavailable       = errors.New("auth service unavailable")
+	ErrMalformedResponse = errors.New("malformed auth service response")
+)
+
+// statusError returns the error for a response of the auth service that is
+// not a 200. A 4xx is reject, unless the body says the token expired, and a
+// 5xx or a 429 is ErrUnavailable.
+func statusError(resp *http.Response, reject error) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == 429 || resp.StatusCode >= 500:
+		return fmt.Errorf("%w: status %d", ErrUnavailable, resp.StatusCode)
+	case resp.StatusCode >= 400 && reject == ErrInvalidToken && strings.Contains(strings.ToLower(string(body)), "expired"):
+		return ErrTokenExpired
+	case resp.StatusCode >= 400:
+		return reject
+	}
+	return fmt.Errorf("%w: status %d", ErrMalformedResponse, resp.StatusCode)
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaults of the auth check cache, see NewAuthService
+const (
+	DEFAULT_AUTH_CACHE_SIZE         = 10000
+	DEFAULT_AUTH_CACHE_TTL          = time.Minute
+	DEFAULT_AUTH_CACHE_NEGATIVE_TTL = 10 * time.Second
+)
+
+// auth modes, chosen with AUTH_MODE
+const (
+	AUTH_MODE_REMOTE   = "remote"
+	AUTH_MODE_LOCAL    = "local"
+	AUTH_MODE_FALLBACK = "fallback"
+)
+
+// tokenAuthService checks tokens with a TokenVerifier instead of asking the
+// auth service. With fallback set, tokens the verifier cannot handle, ones
+// that are not JWTs or are signed with a key it does not know, are still
+// checked by the auth service; tokens with a bad signature or expired are
+// rejected either way. Everything but Check goes to the auth service.
+type tokenAuthService struct {
+	verifier *TokenVerifier
+	remote   AuthService
+	fallback bool
+}
+
+func NewTokenAuthService(verifier *TokenVerifier, remote AuthService, fallback bool) AuthService {
+	return &tokenAuthService{
+		verifier: verifier,
+		remote:   remote,
+		fallback: fallback,
+	}
+}
+
+// NewAuthService builds the AuthService AUTH_MODE asks for. The remote mode,
+// the default, checks every token with the auth service. The local and
+// fallback modes verify tokens against the HMAC secrets of AUTH_JWT_KEYS,
+// given as kid=secret pairs, and the keys of the AUTH_JWKS_FILE key set,
+// requiring the AUTH_JWT_ISSUER issuer and AUTH_JWT_AUDIENCE audience when
+// set.
+//
+// Checks are cached, up to AUTH_CACHE_SIZE tokens for AUTH_CACHE_TTL and
+// rejected tokens for AUTH_CACHE_NEGATIVE_TTL; a size of 0 turns the cache
+// off.
+func NewAuthService() (AuthService, error) {
+
+	checker, err := newChecker()
+	if err != nil {
+		return nil, err
+	}
+
+	size := DEFAULT_AUTH_CACHE_SIZE
+	if size_str := os.Getenv("AUTH_CACHE_SIZE"); size_str != "" {
+		size, err = strconv.Atoi(size_str)
+		if err != nil || size < 0 {
+			return nil, errors.New("invalid AUTH_CACHE_SIZE " + size_str)
+		}
+	}
+	if size == 0 {
+		return checker, nil
+	}
+	ttl, err := envDuration("AUTH_CACHE_TTL", DEFAULT_AUTH_CACHE_TTL)
+	if err != nil {
+		return nil, err
+	}
+	negative_ttl, err := envDuration("AUTH_CACHE_NEGATIVE_TTL", DEFAULT_AUTH_CACHE_NEGATIVE_TTL)
+	if err != nil {
+		return nil, err
+	}
+	return NewCachingAuthService(checker, size, ttl, negative_ttl), nil
+}
+
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New("invalid " + name + " " + value)
+	}
+	return duration, nil
+}
+
+func newChecker() (AuthService, error) {
+
+	remote := NewUserAuthService()
+	mode := os.Getenv("AUTH_MODE")
+	if mode == "" || mode == AUTH_MODE_REMOTE {
+		return remote, nil
+	}
+	if mode != AUTH_MODE_LOCAL && mode != AUTH_MODE_FALLBACK {
+		return nil, errors.New("unknown auth mode " + mode)
+	}
+
+	keys, err := NewKeySet(os.Getenv("AUTH_JWT_KEYS"), os.Getenv("AUTH_JWKS_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys.candidates("")) == 0 {
+		return nil, errors.New("auth mode " + mode + " needs AUTH_JWT_KEYS or AUTH_JWKS_FILE")
+	}
+	verifier := NewTokenVerifier(keys, os.Getenv("AUTH_JWT_ISSUER"), os.Getenv("AUTH_JWT_AUDIENCE"))
+	return NewTokenAuthService(verifier, remote, mode == AUTH_MODE_FALLBACK), nil
+}
+
+func (tokenAuth *tokenAuthService) Login(ctx context.Context, service string, email string, password string) (string, error) {
+	return tokenAuth.remote.Login(ctx, service, email, password)
+}
+
+func (tokenAuth *tokenAuthService) Check(ctx context.Context, service string, token string) (string, error) {
+	user_data, err := tokenAuth.verifier.Verify(token)
+	if tokenAuth.fallback && (err == ErrMalformedToken || err == ErrUnknownKey) {
+		return tokenAuth.remote.Check(ctx, service, token)
+	}
+	return user_data, err
+}
+
+func (tokenAuth *tokenAuthService) Update() (bool, error) {
+	return tokenAuth.remote.Update()
+}
+
+func (tokenAuth *tokenAuthService) Create(ctx context.Context, service string, email string, password string) (bool, error) {
+	return tokenAuth.remote.Create(ctx, service, email, password)
+}
+
+func (tokenAuth *tokenAuthService) Delete(uid string) (bool, error) {
+	return tokenAuth.remote.Delete(uid)
+}
@@ -0,0 +1,374 @@
+package services
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verify fails with ErrMalformedToken for a token that is not a JWT and
+// ErrUnknownKey for one signed with a key the key set does not have, besides
+// ErrInvalidToken and ErrTokenExpired.
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrUnknownKey     = errors.New("unknown token key")
+)
+
+// how often a JWKS file is checked for changes
+const JWKS_REFRESH_INTERVAL = 10 * time.Second
+
+type verificationKey struct {
+	hmac []byte
+	rsa  *rsa.PublicKey
+}
+
+// KeySet holds the keys tokens are verified with, by key id. Keys read from
+// a JWKS file are reloaded when the file changes, so a key is rotated by
+// adding the new key to the file before tokens are signed with it, and
+// removing the old one once the tokens it signed have expired.
+type KeySet struct {
+	lock      sync.RWMutex
+	static    map[string]verificationKey
+	keys      map[string]verificationKey
+	jwks_path string
+	jwks_mod  time.Time
+	checked   time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// NewKeySet builds a key set from static HMAC secrets, given as comma
+// separated kid=secret pairs, and from the JWKS file at jwks_path. Either
+// may be empty.
+func NewKeySet(static_keys string, jwks_path string) (*KeySet, error) {
+
+	ks := &KeySet{
+		static:    map[string]verificationKey{},
+		jwks_path: jwks_path,
+	}
+	for _, pair := range strings.Split(static_keys, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kid_secret := strings.SplitN(pair, "=", 2)
+		if len(kid_secret) != 2 || kid_secret[1] == "" {
+			return nil, errors.New("static key must be kid=secret")
+		}
+		ks.static[strings.TrimSpace(kid_secret[0])] = verificationKey{hmac: []byte(kid_secret[1])}
+	}
+
+	ks.keys = ks.static
+	if jwks_path != "" {
+		if err := ks.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) reload() error {
+
+	info, err := os.Stat(ks.jwks_path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(ks.jwks_path)
+	if err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]verificationKey, len(ks.static)+len(jwks.Keys))
+	for kid, key := range ks.static {
+		keys[kid] = key
+	}
+	for _, jwk := range jwks.Keys {
+		key, err := parseJSONWebKey(jwk)
+		if err != nil {
+			return err
+		}
+		keys[jwk.Kid] = key
+	}
+
+	ks.lock.Lock()
+	ks.keys = keys
+	ks.jwks_mod = info.ModTime()
+	ks.lock.Unlock()
+	return nil
+}
+
+func parseJSONWebKey(jwk jsonWebKey) (verificationKey, error) {
+	switch jwk.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		return verificationKey{hmac: secret}, nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		public_key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		return verificationKey{rsa: public_key}, nil
+	}
+	return verificationKey{}, errors.New("unsupported key type " + jwk.Kty)
+}
+
+// refresh reloads the JWKS file if it changed since it was last read. A
+// file that cannot be read keeps the keys loaded before.
+func (ks *KeySet) refresh() {
+
+	if ks.jwks_path == "" {
+		return
+	}
+	ks.lock.Lock()
+	if time.Since(ks.checked) < JWKS_REFRESH_INTERVAL {
+		ks.lock.Unlock()
+		return
+	}
+	ks.checked = time.Now()
+	mod := ks.jwks_mod
+	ks.lock.Unlock()
+
+	info, err := os.Stat(ks.jwks_path)
+	if err != nil || info.ModTime().Equal(mod) {
+		return
+	}
+	ks.reload()
+}
+
+// candidates returns the key with the given id, or every key when the token
+// does not name one.
+func (ks *KeySet) candidates(kid string) []verificationKey {
+
+	ks.refresh()
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	if kid != "" {
+		if key, ok := ks.keys[kid]; ok {
+			return []verificationKey{key}
+		}
+		return nil
+	}
+	keys := make([]verificationKey, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// TokenVerifier validates signed JWTs locally, without asking the auth
+// service. It accepts HS256, HS384, HS512, RS256, RS384 and RS512 tokens,
+// and checks their expiry and, when configured, their issuer and audience.
+type TokenVerifier struct {
+	keys     *KeySet
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+func NewTokenVerifier(keys *KeySet, issuer string, audience string) *TokenVerifier {
+	return &TokenVerifier{
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+		now:      time.Now,
+	}
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Subject   string          `json:"sub"`
+	Uid       string          `json:"uid"`
+	Email     string          `json:"email"`
+	Role      string          `json:"role"`
+	Created   string          `json:"created"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// Verify checks token and returns the user data it carries, as the JSON
+// object the auth service answers a check with.
+func (verifier *TokenVerifier) Verify(token string) (string, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrMalformedToken
+	}
+
+	header := tokenHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", ErrMalformedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformedToken
+	}
+
+	keys := verifier.keys.candidates(header.Kid)
+	if len(keys) == 0 {
+		return "", ErrUnknownKey
+	}
+	signed := parts[0] + "." + parts[1]
+	verified := false
+	for _, key := range keys {
+		if verifySignature(header.Alg, key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", ErrInvalidToken
+	}
+
+	claims := tokenClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", ErrMalformedToken
+	}
+	if err := verifier.validate(claims); err != nil {
+		return "", err
+	}
+
+	uid := claims.Uid
+	if uid == "" {
+		uid = claims.Subject
+	}
+	user_data, err := json.Marshal(map[string]string{
+		"uid":     uid,
+		"email":   claims.Email,
+		"role":    claims.Role,
+		"created": claims.Created,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(user_data), nil
+}
+
+func (verifier *TokenVerifier) validate(claims tokenClaims) error {
+
+	now := float64(verifier.now().Unix())
+	if claims.ExpiresAt == nil || now >= *claims.ExpiresAt {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return ErrInvalidToken
+	}
+	if claims.Uid == "" && claims.Subject == "" {
+		return ErrInvalidToken
+	}
+	if verifier.issuer != "" && claims.Issuer != verifier.issuer {
+		return ErrInvalidToken
+	}
+	if verifier.audience != "" && !hasAudience(claims.Audience, verifier.audience) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list of
+// strings, contains audience.
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenExpiry returns the exp claim of a JWT, without verifying it, and
+// false for tokens that are not JWTs or have no expiry.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	claims := tokenClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.ExpiresAt == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.ExpiresAt), 0), true
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key verificationKey, signed string, signature []byte) bool {
+
+	var new_hash func() hash.Hash
+	var crypto_hash crypto.Hash
+	switch alg {
+	case "HS256", "RS256":
+		new_hash, crypto_hash = sha256.New, crypto.SHA256
+	case "HS384", "RS384":
+		new_hash, crypto_hash = sha512.New384, crypto.SHA384
+	case "HS512", "RS512":
+		new_hash, crypto_hash = sha512.New, crypto.SHA512
+	default:
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS") && key.hmac != nil:
+		mac := hmac.New(new_hash, key.hmac)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case strings.HasPrefix(alg, "RS") && key.rsa != nil:
+		digest := new_hash()
+		digest.Write([]byte(signed))
+		return rsa.VerifyPKCS1v15(key.rsa, crypto_hash, digest.Sum(nil), signature) == nil
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(kid string, secret string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "HS256", "kid": kid}) + "." + encodeSegment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(kid string, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func userClaims(exp time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":     "1",
+		"email":   "test@email.com",
+		"role":    "standard",
+		"created": "2020-07-26T15:21:10.035Z",
+		"exp":     exp.Unix(),
+	}
+}
+
+func writeJWKS(t *testing.T, path string, kid string, key *rsa.PrivateKey) {
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+	data, _ := json.Marshal(jwks)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyHS256(t *testing.T) {
+
+	keys, err := NewKeySet("k1=secret", "")
+	assert.NoError(t, err)
+	verifier := NewTokenVerifier(keys, "", "")
+	expire := time.Now().Add(time.Hour)
+
+	user_data, err := verifier.Verify(signHS256("k1", "secret", userClaims(expire)))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"uid":"1","email":"test@email.com","role":"standard","created":"2020-07-26T15:21:10.035Z"}`, user_data)
+
+	_, err = verifier.Verify(signHS256("k1", "other", userClaims(expire)))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, err = verifier.Verify(signHS256("k2", "secret", userClaims(expire)))
+	assert.Equal(t, ErrUnknownKey, err)
+
+	_, err = verifier.Verify(signHS256("k1", "secret", userClaims(time.Now().Add(-time.Minute))))
+	assert.Equal(t, ErrTokenExpired, err)
+
+	_, err = verifier.Verify("opaque-token")
+	assert.Equal(t, ErrMalformedToken, err)
+}
+
+func TestVerifyRejectsAlgorithmMismatch(t *testing.T) {
+
+	keys, _ := NewKeySet("k1=secret", "")
+	verifier := NewTokenVerifier(keys, "", "")
+
+	none := encodeSegment(map[string]string{"alg": "none", "kid": "k1"}) + "." + encodeSegment(userClaims(time.Now().Add(time.Hour))) + "."
+	_, err := verifier.Verify(none)
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestVerifyIssuerAudience(t *testing.T) {
+
+	keys, _ := NewKeySet("k1=secret", "")
+	verifier := NewTokenVerifier(keys, "auth-service", "like-service")
+
+	claims := userClaims(time.Now().Add(time.Hour))
+	claims["iss"] = "auth-service"
+	claims["aud"] = []string{"post-service", "like-service"}
+	_, err := verifier.Verify(signHS256("k1", "secret", claims))
+	assert.NoError(t, err)
+
+	claims["aud"] = "post-service"
+	_, err = verifier.Verify(signHS256("k1", "secret", claims))
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestVerifyRS256KeyRotation(t *testing.T) {
+
+	old_key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	new_key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, "old", old_key)
+
+	keys, err := NewKeySet("", path)
+	assert.NoError(t, err)
+	verifier := NewTokenVerifier(keys, "", "")
+	expire := time.Now().Add(time.Hour)
+
+	_, err = verifier.Verify(signRS256("old", old_key, userClaims(expire)))
+	assert.NoError(t, err)
+	_, err = verifier.Verify(signRS256("new", new_key, userClaims(expire)))
+	assert.Equal(t, ErrUnknownKey, err)
+
+	writeJWKS(t, path, "new", new_key)
+	modified := time.Now().Add(time.Second)
+	os.Chtimes(path, modified, modified)
+	keys.checked = time.Time{}
+
+	_, err = verifier.Verify(signRS256("new", new_key, userClaims(expire)))
+	assert.NoError(t, err)
+	_, err = verifier.Verify(signRS256("old", old_key, userClaims(expire)))
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+type remoteCheck struct {
+	userAuthService
+	checked int
+}
+
+func (remote *remoteCheck) Check(ctx context.Context, service string, token string) (string, error) {
+	remote.checked++
+	return `{"uid":"2"}`, nil
+}
+
+func TestTokenAuthServiceFallback(t *testing.T) {
+
+	keys, _ := NewKeySet("k1=secret", "")
+	verifier := NewTokenVerifier(keys, "", "")
+	remote := &remoteCheck{}
+	ctx := context.Background()
+
+	local := NewTokenAuthService(verifier, remote, false)
+	_, err := local.Check(ctx, "like-service", "opaque-token")
+	assert.Equal(t, ErrMalformedToken, err)
+	assert.Equal(t, 0, remote.checked)
+
+	fallback := NewTokenAuthService(verifier, remote, true)
+	user_data, err := fallback.Check(ctx, "like-service", "opaque-token")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uid":"2"}`, user_data)
+	assert.Equal(t, 1, remote.checked)
+
+	_, err = fallback.Check(ctx, "like-service", signHS256("k1", "other", userClaims(time.Now().Add(time.Hour))))
+	assert.Equal(t, ErrInvalidToken, err)
+	assert.Equal(t, 1, remote.checked)
+}
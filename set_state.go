@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vinhut/like-service/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	errMissingParam = errors.New("missing parameter")
+	errInvalidParam = errors.New("invalid parameter")
+)
+
+// SetStateResponse is the state of a target after a set state request, and
+// the version of the caller's like to make the next change conditional on.
+type SetStateResponse struct {
+	TargetState
+	Version int `json:"version"`
+}
+
+type setStateRequest struct {
+	Liked    *bool  `json:"liked"`
+	Reaction string `json:"reaction"`
+	Version  *int   `json:"version"`
+}
+
+// readSetState reads the desired state from a JSON body, or else from the
+// liked, reaction and version query parameters. A missing version is -1.
+func readSetState(c *gin.Context) (setStateRequest, int, bool) {
+
+	request := setStateRequest{}
+	if c.Request.ContentLength != 0 {
+		if bind_err := c.ShouldBindJSON(&request); bind_err != nil {
+			abortError(c, 400, "invalid_body", "invalid body")
+			return request, 0, false
+		}
+	} else {
+		if liked_str, ok := c.GetQuery("liked"); ok {
+			liked, parse_err := strconv.ParseBool(liked_str)
+			if parse_err != nil {
+				abortInvalid(c, "liked", parse_err)
+				return request, 0, false
+			}
+			request.Liked = &liked
+		}
+		request.Reaction = c.Query("reaction")
+		if version_str, ok := c.GetQuery("version"); ok {
+			version, parse_err := strconv.Atoi(version_str)
+			if parse_err != nil {
+				abortInvalid(c, "version", parse_err)
+				return request, 0, false
+			}
+			request.Version = &version
+		}
+	}
+
+	if request.Liked == nil {
+		abortInvalid(c, "liked", errMissingParam)
+		return request, 0, false
+	}
+	expected := -1
+	if request.Version != nil {
+		if *request.Version < 0 {
+			abortInvalid(c, "version", errInvalidParam)
+			return request, 0, false
+		}
+		expected = *request.Version
+	}
+	return request, expected, true
+}
+
+// setStateHandler sets whether the caller likes a target, which unlike a
+// like then unlike does not depend on what the caller did before. Given the
+// version the caller last saw, it fails with a 409 and the current version
+// in the Like-Version header when another change came in between.
+func setStateHandler(likedb models.LikeDatabase, params targetParams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := params.target(c)
+		tagTarget(c, target)
+		user_data := currentUser(c)
+
+		request, expected, ok := readSetState(c)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+		like := models.Like{
+			Likeid:     primitive.NewObjectIDFromTimestamp(now),
+			Uid:        user_data.Uid,
+			Targettype: target.Type,
+			Targetid:   target.Id,
+			Reaction:   request.Reaction,
+			Created:    now,
+		}
+		version, set_err := likedb.SetLike(c.Request.Context(), like, *request.Liked, expected)
+		if set_err == models.ErrVersionConflict {
+			c.Header("Like-Version", strconv.Itoa(version))
+			abortError(c, 409, "version_conflict", "version conflict")
+			return
+		}
+		if set_err != nil {
+			abortModelError(c, set_err)
+			return
+		}
+
+		state, ok := targetState(c, likedb, target)
+		if !ok {
+			return
+		}
+		if *request.Liked {
+			// liking a target liked before keeps the time it was liked at
+			stored, liked, find_err := likedb.FindLike(c.Request.Context(), target, user_data.Uid)
+			if find_err != nil {
+				abortModelError(c, find_err)
+				return
+			}
+			if liked {
+				state.Liked = true
+				state.Reaction = stored.Reaction
+				state.LikedAt = &stored.Created
+			}
+		}
+		c.Header("Like-Version", strconv.Itoa(version))
+		c.JSON(200, SetStateResponse{TargetState: state, Version: version})
+
+	}
+}
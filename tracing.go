@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	jaeger "github.com/uber/jaeger-client-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+	jaegerlog "github.com/uber/jaeger-client-go/log"
+	transport "github.com/uber/jaeger-client-go/transport/zipkin"
+	"github.com/uber/jaeger-client-go/zipkin"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/vinhut/like-service/models"
+
+	"os"
+)
+
+// initTracer sets up the global jaeger tracer, propagating spans in Zipkin
+// B3 headers.
+func initTracer() opentracing.Tracer {
+
+	var JAEGER_COLLECTOR_ENDPOINT = os.Getenv("JAEGER_COLLECTOR_ENDPOINT")
+	zipkinPropagator := zipkin.NewZipkinB3HTTPHeaderPropagator()
+	trsport, _ := transport.NewHTTPTransport(
+		JAEGER_COLLECTOR_ENDPOINT,
+		transport.HTTPLogger(jaeger.StdLogger),
+	)
+	cfg := jaegercfg.Configuration{
+		ServiceName: "like-service",
+		Sampler: &jaegercfg.SamplerConfig{
+			Type:  "const",
+			Param: 1,
+		},
+		Reporter: &jaegercfg.ReporterConfig{
+			LogSpans:          true,
+			CollectorEndpoint: JAEGER_COLLECTOR_ENDPOINT,
+		},
+	}
+	jLogger := jaegerlog.StdLogger
+	jMetricsFactory := metrics.NullFactory
+	cfg.InitGlobalTracer(
+		"like-service",
+		jaegercfg.Logger(jLogger),
+		jaegercfg.Metrics(jMetricsFactory),
+		jaegercfg.Injector(opentracing.HTTPHeaders, zipkinPropagator),
+		jaegercfg.Extractor(opentracing.HTTPHeaders, zipkinPropagator),
+		jaegercfg.ZipkinSharedRPCSpan(true),
+		jaegercfg.Reporter(jaeger.NewRemoteReporter(trsport)),
+	)
+	return opentracing.GlobalTracer()
+}
+
+// tracingMiddleware starts one server span per request and stores it in the
+// request context, so the storage and auth calls made for the request are
+// traced as its children. The span joins the trace of the caller when the
+// request carries its B3 headers.
+func tracingMiddleware(tracer opentracing.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		parent, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		span := tracer.StartSpan(c.Request.Method+" "+route, ext.RPCServerOption(parent))
+		defer span.Finish()
+		ext.HTTPMethod.Set(span, c.Request.Method)
+		ext.HTTPUrl.Set(span, c.Request.URL.String())
+		span.SetTag("route", route)
+
+		c.Request = c.Request.WithContext(opentracing.ContextWithSpan(c.Request.Context(), span))
+		c.Next()
+
+		status := c.Writer.Status()
+		ext.HTTPStatusCode.Set(span, uint16(status))
+		if status >= 500 {
+			ext.Error.Set(span, true)
+		}
+	}
+}
+
+// tagSpan tags the server span of the request, if it is traced.
+func tagSpan(c *gin.Context, key string, value interface{}) {
+	if span := opentracing.SpanFromContext(c.Request.Context()); span != nil {
+		span.SetTag(key, value)
+	}
+}
+
+func tagTarget(c *gin.Context, target models.Target) {
+	tagSpan(c, "target.type", target.Type)
+	tagSpan(c, "target.id", target.Id)
+}
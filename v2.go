@@ -0,0 +1,333 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vinhut/like-service/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"strconv"
+	"time"
+)
+
+// the gin context key of the API version a route belongs to
+const API_VERSION_KEY = "api_version"
+
+// ErrorResponse is the body of every v2 error. Code is stable and meant for
+// programs, Message for people.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+// TargetState is the like state of a target as seen by the caller. Liked,
+// Reaction, LikedAt and Version are unset for anonymous callers. Version is
+// the version of the caller's like, to make a set state conditional on.
+type TargetState struct {
+	Target    models.Target  `json:"target"`
+	Count     int            `json:"count"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Liked     bool           `json:"liked"`
+	Reaction  string         `json:"reaction,omitempty"`
+	LikedAt   *time.Time     `json:"liked_at,omitempty"`
+	Version   *int           `json:"version,omitempty"`
+}
+
+type StatesResponse struct {
+	States []TargetState `json:"states"`
+}
+
+type LikersResponse struct {
+	Target models.Target  `json:"target"`
+	Likers []models.Liker `json:"likers"`
+	Next   string         `json:"next,omitempty"`
+}
+
+type UserLikesResponse struct {
+	Likes []models.UserLike `json:"likes"`
+	Next  string            `json:"next,omitempty"`
+}
+
+type likeRequest struct {
+	Reaction string `json:"reaction"`
+}
+
+// apiVersion marks the routes of a group as belonging to an API version,
+// which decides the shape of their error bodies.
+func apiVersion(version int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(API_VERSION_KEY, version)
+		c.Next()
+	}
+}
+
+// abortError ends the request with an error, in the ErrorResponse envelope
+// on v2 routes and as the reason older clients expect everywhere else.
+func abortError(c *gin.Context, status int, code string, message string) {
+	if c.GetInt(API_VERSION_KEY) >= 2 {
+		c.AbortWithStatusJSON(status, ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+		return
+	}
+	c.AbortWithStatusJSON(status, gin.H{"reason": message})
+}
+
+// abortInvalid ends the request with a 400 naming the parameter field that
+// failed validation with err.
+func abortInvalid(c *gin.Context, field string, err error) {
+	message := "invalid " + field
+	if err == models.ErrMissingTargetId || err == models.ErrMissingUid || err == errMissingParam {
+		message = "missing " + field
+	}
+	if c.GetInt(API_VERSION_KEY) >= 2 {
+		c.AbortWithStatusJSON(400, ErrorResponse{Error: ErrorDetail{Code: "invalid_argument", Message: message, Field: field}})
+		return
+	}
+	c.AbortWithStatusJSON(400, gin.H{"reason": message, "field": field})
+}
+
+// abortModelError ends a v2 request with the error a LikeDatabase call
+// failed with.
+func abortModelError(c *gin.Context, err error) {
+	switch err {
+	case models.ErrInvalidTargetType:
+		abortError(c, 404, "unknown_target_type", "unknown target type")
+	case models.ErrInvalidCursor:
+		abortError(c, 400, "invalid_cursor", "invalid cursor")
+	case models.ErrInvalidLimit:
+		abortError(c, 400, "invalid_limit", "invalid limit")
+	case models.ErrInvalidReaction:
+		abortError(c, 400, "invalid_reaction", "invalid reaction")
+	case models.ErrMissingTargetId, models.ErrInvalidTargetId:
+		abortInvalid(c, "id", err)
+	default:
+		switch storageErrorStatus(err) {
+		case 504:
+			abortError(c, 504, "storage_timeout", "storage timed out")
+		case 503:
+			abortError(c, 503, "storage_unavailable", "storage unavailable")
+		default:
+			abortError(c, 500, "internal_error", "internal error")
+		}
+	}
+}
+
+func setupV2Routes(router *gin.Engine, likedb models.LikeDatabase, required gin.HandlerFunc, optional gin.HandlerFunc, once gin.HandlerFunc) {
+
+	v2 := router.Group(SERVICE_NAME+"/v2", apiVersion(2))
+	v2.GET("/target/:type", optional, v2StatesHandler(likedb))
+	valid := validTarget(path_target)
+	v2.GET("/target/:type/:id", optional, valid, v2StateHandler(likedb))
+	v2.GET("/target/:type/:id/likers", required, valid, v2LikersHandler(likedb))
+	v2.POST("/target/:type/:id/like", required, valid, once, v2CreateLikeHandler(likedb))
+	v2.DELETE("/target/:type/:id/like", required, valid, once, v2DeleteLikeHandler(likedb))
+	v2.PUT("/target/:type/:id/like", required, valid, once, setStateHandler(likedb, path_target))
+	v2.GET("/user/likes", required, v2UserLikeHandler(likedb))
+}
+
+// targetState reads the count of target for a state whose liked part the
+// caller fills in.
+func targetState(c *gin.Context, likedb models.LikeDatabase, target models.Target) (TargetState, bool) {
+	like_count, reactions, find_err := likedb.FindCount(c.Request.Context(), target)
+	if find_err != nil {
+		abortModelError(c, find_err)
+		return TargetState{}, false
+	}
+	return TargetState{Target: target, Count: like_count, Reactions: reactions}, true
+}
+
+func v2StateHandler(likedb models.LikeDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := path_target.target(c)
+		tagTarget(c, target)
+
+		state, ok := targetState(c, likedb, target)
+		if !ok {
+			return
+		}
+		if user_data := currentUser(c); user_data != nil {
+			like, liked, find_err := likedb.FindLike(c.Request.Context(), target, user_data.Uid)
+			if find_err != nil {
+				abortModelError(c, find_err)
+				return
+			}
+			if liked {
+				state.Liked = true
+				state.Reaction = like.Reaction
+				state.LikedAt = &like.Created
+			}
+			version, find_err := likedb.FindVersion(c.Request.Context(), target, user_data.Uid)
+			if find_err != nil {
+				abortModelError(c, find_err)
+				return
+			}
+			state.Version = &version
+			c.Header("Like-Version", strconv.Itoa(version))
+		}
+		c.JSON(200, state)
+
+	}
+}
+
+func v2StatesHandler(likedb models.LikeDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		targettype := c.Param("type")
+		tagSpan(c, "target.type", targettype)
+
+		target_ids := c.QueryArray("id")
+		if len(target_ids) == 0 || len(target_ids) > MAX_BATCH_SIZE {
+			abortError(c, 400, "invalid_argument", "between 1 and "+strconv.Itoa(MAX_BATCH_SIZE)+" id required")
+			return
+		}
+		if !validIds(c, targettype, "id", target_ids) {
+			return
+		}
+		uid := ""
+		if user_data := currentUser(c); user_data != nil {
+			uid = user_data.Uid
+		}
+
+		states, find_err := likedb.FindStates(c.Request.Context(), targettype, target_ids, uid)
+		if find_err != nil {
+			abortModelError(c, find_err)
+			return
+		}
+		result := StatesResponse{States: make([]TargetState, len(states))}
+		for i, state := range states {
+			result.States[i] = TargetState{
+				Target:   models.Target{Type: targettype, Id: state.Targetid},
+				Count:    state.Count,
+				Liked:    state.Liked,
+				Reaction: state.Reaction,
+			}
+		}
+		c.JSON(200, result)
+
+	}
+}
+
+func v2LikersHandler(likedb models.LikeDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := path_target.target(c)
+		tagTarget(c, target)
+
+		cursor, _ := c.GetQuery("cursor")
+		limit, limit_ok := pageLimit(c)
+		if !limit_ok {
+			abortError(c, 400, "invalid_limit", "invalid limit")
+			return
+		}
+
+		likers, next, find_err := likedb.FindLikers(c.Request.Context(), target, cursor, limit)
+		if find_err != nil {
+			abortModelError(c, find_err)
+			return
+		}
+		c.JSON(200, LikersResponse{Target: target, Likers: likers, Next: next})
+
+	}
+}
+
+func v2CreateLikeHandler(likedb models.LikeDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := path_target.target(c)
+		tagTarget(c, target)
+		user_data := currentUser(c)
+
+		request := likeRequest{}
+		if c.Request.ContentLength != 0 {
+			if bind_err := c.ShouldBindJSON(&request); bind_err != nil {
+				abortError(c, 400, "invalid_body", "invalid body")
+				return
+			}
+		}
+
+		now := time.Now()
+		new_like := models.Like{
+			Likeid:     primitive.NewObjectIDFromTimestamp(now),
+			Uid:        user_data.Uid,
+			Targettype: target.Type,
+			Targetid:   target.Id,
+			Reaction:   request.Reaction,
+			Created:    now,
+		}
+		_, create_err := likedb.CreateLike(c.Request.Context(), new_like)
+		if create_err != nil {
+			abortModelError(c, create_err)
+			return
+		}
+
+		state, ok := targetState(c, likedb, target)
+		if !ok {
+			return
+		}
+		// a repeated like keeps the time it was first made at
+		like, liked, find_err := likedb.FindLike(c.Request.Context(), target, user_data.Uid)
+		if find_err != nil {
+			abortModelError(c, find_err)
+			return
+		}
+		if liked {
+			state.Liked = true
+			state.Reaction = like.Reaction
+			state.LikedAt = &like.Created
+		}
+		c.JSON(200, state)
+
+	}
+}
+
+func v2DeleteLikeHandler(likedb models.LikeDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		target := path_target.target(c)
+		tagTarget(c, target)
+		user_data := currentUser(c)
+
+		_, delete_err := likedb.DeleteLike(c.Request.Context(), target, user_data.Uid)
+		if delete_err != nil {
+			abortModelError(c, delete_err)
+			return
+		}
+
+		state, ok := targetState(c, likedb, target)
+		if !ok {
+			return
+		}
+		c.JSON(200, state)
+
+	}
+}
+
+func v2UserLikeHandler(likedb models.LikeDatabase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		user_data := currentUser(c)
+		target_type, _ := c.GetQuery("type")
+		cursor, _ := c.GetQuery("cursor")
+		limit, limit_ok := pageLimit(c)
+		if !limit_ok {
+			abortError(c, 400, "invalid_limit", "invalid limit")
+			return
+		}
+
+		user_like, next, find_err := likedb.FindUserLike(c.Request.Context(), user_data.Uid, target_type, cursor, limit)
+		if find_err == models.ErrInvalidTargetType {
+			abortError(c, 400, "invalid_type", "invalid type")
+			return
+		}
+		if find_err != nil {
+			abortModelError(c, find_err)
+			return
+		}
+		c.JSON(200, UserLikesResponse{Likes: user_like, Next: next})
+
+	}
+}